@@ -0,0 +1,19 @@
+// Package clock abstracts the passage of time, so that the timers
+// used by the node can be driven by tests.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the wall clock.
+type Real struct{}
+
+func (c Real) Now() time.Time                         { return time.Now() }
+func (c Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
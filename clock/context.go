@@ -0,0 +1,62 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithTimeout is like context.WithTimeout, except that the timeout
+// elapses on the clock, so that the deadlines of requests can be
+// driven by tests too.
+func WithTimeout(parent context.Context, c Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := c.(Real); ok {
+		return context.WithTimeout(parent, timeout)
+	}
+
+	inner, cancel := context.WithCancel(parent)
+	ctx := &timeoutCtx{
+		Context:  inner,
+		deadline: c.Now().Add(timeout),
+	}
+
+	expired := c.After(timeout)
+	go func() {
+		select {
+		case <-expired:
+			ctx.mtx.Lock()
+			ctx.expired = true
+			ctx.mtx.Unlock()
+			cancel()
+
+		case <-inner.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// timeoutCtx is a context which is canceled at a deadline
+// on a clock other than the wall clock.
+type timeoutCtx struct {
+	context.Context
+
+	deadline time.Time
+	expired  bool
+	mtx      sync.Mutex
+}
+
+func (c *timeoutCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *timeoutCtx) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.expired {
+		return context.DeadlineExceeded
+	}
+
+	return c.Context.Err()
+}
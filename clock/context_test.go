@@ -0,0 +1,51 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithTimeout(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewMock(start)
+
+	ctx, cancel := WithTimeout(context.Background(), c, time.Second)
+	defer cancel()
+
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(start.Add(time.Second)) {
+		t.Fatal("incorrect deadline")
+	}
+
+	c.Advance(time.Second - 1)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context expired too early")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	c.Advance(1)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected context to expire")
+	}
+
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded error, got", ctx.Err())
+	}
+}
+
+func TestWithTimeout_Cancel(t *testing.T) {
+	c := NewMock(time.Unix(0, 0))
+
+	ctx, cancel := WithTimeout(context.Background(), c, time.Second)
+	cancel()
+
+	<-ctx.Done()
+	if ctx.Err() != context.Canceled {
+		t.Fatal("expected canceled error, got", ctx.Err())
+	}
+}
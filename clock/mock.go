@@ -0,0 +1,143 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Mock is a Clock which only moves forward when Advance or FireNext
+// is called.
+type Mock struct {
+	mtx     sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	deadline time.Time
+	key      string
+	ch       chan time.Time
+}
+
+// NewMock creates a mock clock set to now.
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+func (c *Mock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.now
+}
+
+func (c *Mock) After(d time.Duration) <-chan time.Time {
+	return c.AfterKey(d, "")
+}
+
+// AfterKey is like After, except that FireNext fires the timers which
+// expire at the same time in the order of their keys, rather than in
+// the order they were created in. That order is more stable when the
+// timers are created concurrently.
+func (c *Mock) AfterKey(d time.Duration, key string) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// The channel is buffered so that firing a timer
+	// never blocks, like time.After.
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, waiter{
+		deadline: c.now.Add(d),
+		key:      key,
+		ch:       ch,
+	})
+
+	return ch
+}
+
+// Advance moves the clock forward, firing every timer
+// which expires in the meantime.
+func (c *Mock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.now = c.now.Add(d)
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+
+		w.ch <- c.now
+	}
+
+	c.waiters = pending
+}
+
+// Next returns the deadline of the timer which expires first.
+// It returns false if no timer is pending.
+func (c *Mock) Next() (time.Time, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	i := c.next()
+	if i < 0 {
+		return time.Time{}, false
+	}
+
+	return c.waiters[i].deadline, true
+}
+
+// FireNext moves the clock forward to the timer which expires first,
+// and fires it alone, unless it expires after until, so that the
+// reaction to each timer can be observed on its own. Timers expiring at
+// the same time fire in the order of their keys, then in the order they
+// were created in. It returns false if no timer expires until then.
+func (c *Mock) FireNext(until time.Time) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	i := c.next()
+	if i < 0 || c.waiters[i].deadline.After(until) {
+		return false
+	}
+
+	w := c.waiters[i]
+	c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+
+	if w.deadline.After(c.now) {
+		c.now = w.deadline
+	}
+
+	w.ch <- c.now
+	return true
+}
+
+// next returns the index of the timer which fires next,
+// or -1 if there's none. The mutex must be held.
+func (c *Mock) next() int {
+	next := -1
+	for i, w := range c.waiters {
+		if next < 0 || w.deadline.Before(c.waiters[next].deadline) ||
+			(w.deadline.Equal(c.waiters[next].deadline) && w.key < c.waiters[next].key) {
+			next = i
+		}
+	}
+
+	return next
+}
+
+// Waiters returns the number of timers which have not fired yet.
+func (c *Mock) Waiters() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return len(c.waiters)
+}
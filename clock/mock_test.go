@@ -0,0 +1,118 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMock_Advance(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewMock(start)
+
+	short := c.After(time.Second)
+	long := c.After(time.Minute)
+
+	if c.Waiters() != 2 {
+		t.Fatal("incorrect number of waiters")
+	}
+
+	c.Advance(time.Second)
+
+	select {
+	case now := <-short:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatal("timer fired with incorrect time")
+		}
+	default:
+		t.Fatal("expected timer to fire")
+	}
+
+	select {
+	case <-long:
+		t.Fatal("timer fired too early")
+	default:
+	}
+
+	if c.Waiters() != 1 {
+		t.Fatal("incorrect number of waiters")
+	}
+
+	c.Advance(time.Hour)
+	<-long
+
+	if !c.Now().Equal(start.Add(time.Second + time.Hour)) {
+		t.Fatal("incorrect time")
+	}
+}
+
+func TestMock_AfterZero(t *testing.T) {
+	c := NewMock(time.Unix(0, 0))
+
+	select {
+	case <-c.After(0):
+	default:
+		t.Fatal("expected timer to fire immediately")
+	}
+}
+
+func TestMock_FireNext(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewMock(start)
+
+	second := c.After(2 * time.Second)
+	first := c.After(time.Second)
+	third := c.After(2 * time.Second)
+
+	if next, ok := c.Next(); !ok || !next.Equal(start.Add(time.Second)) {
+		t.Fatal("incorrect next deadline")
+	}
+
+	if c.FireNext(start.Add(time.Second - 1)) {
+		t.Fatal("expected no timer to expire until then")
+	}
+
+	for i, ch := range []<-chan time.Time{first, second, third} {
+		if !c.FireNext(start.Add(time.Minute)) {
+			t.Fatalf("expected timer %d to fire", i)
+		}
+
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("expected timer %d to fire", i)
+		}
+
+		if c.Waiters() != 2-i {
+			t.Fatal("incorrect number of waiters")
+		}
+	}
+
+	if !c.Now().Equal(start.Add(2 * time.Second)) {
+		t.Fatal("incorrect time")
+	}
+
+	if c.FireNext(start.Add(time.Minute)) {
+		t.Fatal("expected no timer to be left")
+	}
+
+	if _, ok := c.Next(); ok {
+		t.Fatal("expected no timer to be left")
+	}
+}
+
+func TestMock_AfterKey(t *testing.T) {
+	c := NewMock(time.Unix(0, 0))
+
+	b := c.AfterKey(time.Second, "b")
+	a := c.AfterKey(time.Second, "a")
+
+	for _, ch := range []<-chan time.Time{a, b} {
+		c.FireNext(c.Now().Add(time.Second))
+
+		select {
+		case <-ch:
+		default:
+			t.Fatal("timers fired out of the order of their keys")
+		}
+	}
+}
@@ -3,6 +3,7 @@ package ed25519
 import (
 	"fmt"
 
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/sign/eddsa"
 	"go.dedis.ch/kyber/v3/suites"
 )
@@ -14,34 +15,25 @@ func init() {
 }
 
 func GenerateKey() (privkey []byte, pubkey []byte, err error) {
-	priv := ed25519.Scalar().Pick(ed25519.RandomStream())
-	pub := ed25519.Point().Mul(priv, nil)
-
-	privkey, err = priv.MarshalBinary()
-	if err != nil {
-		return
-	}
-
-	pubkey, err = pub.MarshalBinary()
-	return
+	return newKey(ed25519.Scalar().Pick(ed25519.RandomStream()))
 }
 
-func ComputeSharedSecret(privkey []byte, pubkey []byte) (secBuf []byte, err error) {
-	priv := ed25519.Scalar()
-	pub := ed25519.Point()
+// KeyFromSeed derives a key pair from the seed, so that the same seed
+// always gives the same key pair. It's meant for simulations and tests
+// which must be replayable, since the key is only as secret as the seed.
+func KeyFromSeed(seed []byte) (privkey []byte, pubkey []byte, err error) {
+	return newKey(ed25519.Scalar().Pick(ed25519.XOF(seed)))
+}
 
-	err = priv.UnmarshalBinary(privkey)
-	if err != nil {
-		return
-	}
+func newKey(priv kyber.Scalar) (privkey []byte, pubkey []byte, err error) {
+	pub := ed25519.Point().Mul(priv, nil)
 
-	err = pub.UnmarshalBinary(pubkey)
+	privkey, err = priv.MarshalBinary()
 	if err != nil {
 		return
 	}
 
-	secret := ed25519.Point().Mul(priv, pub)
-	secBuf, err = secret.MarshalBinary()
+	pubkey, err = pub.MarshalBinary()
 	return
 }
 
@@ -5,25 +5,6 @@ import (
 	"testing"
 )
 
-func TestComputeSharedSecret(t *testing.T) {
-	a, A, _ := GenerateKey()
-	b, B, _ := GenerateKey()
-
-	secretA, err := ComputeSharedSecret(a, B)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	secretB, err := ComputeSharedSecret(b, A)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if !bytes.Equal(secretA, secretB) {
-		t.Fatal("aB is not equal to bA")
-	}
-}
-
 func TestSignVerify(t *testing.T) {
 	priv, pub, _ := GenerateKey()
 
@@ -44,3 +25,29 @@ func TestSignVerify(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyFromSeed(t *testing.T) {
+	priv1, pub1, err := KeyFromSeed([]byte("seed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv2, pub2, _ := KeyFromSeed([]byte("seed"))
+	if !bytes.Equal(priv1, priv2) || !bytes.Equal(pub1, pub2) {
+		t.Fatal("expected the same seed to give the same key pair")
+	}
+
+	_, pub3, _ := KeyFromSeed([]byte("other seed"))
+	if bytes.Equal(pub1, pub3) {
+		t.Fatal("expected different seeds to give different key pairs")
+	}
+
+	sig, err := Sign(priv1, pub1, []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(pub1, []byte("message"), sig); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,181 @@
+package keystore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Version is the version of the key file format.
+	Version = 1
+
+	SaltSize = 32
+	KeySize  = 32
+
+	// Default scrypt parameters, as recommended by the scrypt
+	// package for interactive logins.
+	ScryptN = 32768
+	ScryptR = 8
+	ScryptP = 1
+)
+
+var (
+	ErrInvalidPassphrase = fmt.Errorf("invalid passphrase or corrupted key file")
+	ErrUnsupportedFormat = fmt.Errorf("unsupported key file format")
+)
+
+// Identity is a node's long-term key pair.
+type Identity struct {
+	PrivateKey []byte
+	PublicKey  []byte
+}
+
+// keyFile is the on-disk representation of an identity.
+// The private key is encrypted with XChaCha20-Poly1305 using
+// a key derived from the passphrase with scrypt. The public key
+// is stored in the clear and is authenticated as associated data.
+type keyFile struct {
+	Version    int    `json:"version"`
+	PublicKey  []byte `json:"public_key"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Create generates a new identity and stores it at path,
+// encrypted with the passphrase. It fails if the file already exists.
+func Create(path string, passphrase []byte) (Identity, error) {
+	privkey, pubkey, err := ed25519.GenerateKey()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{PrivateKey: privkey, PublicKey: pubkey}
+	if err := Store(path, passphrase, identity); err != nil {
+		return Identity{}, err
+	}
+
+	return identity, nil
+}
+
+// Store encrypts the identity with the passphrase and writes it
+// to path. It fails if the file already exists.
+func Store(path string, passphrase []byte, identity Identity) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("key file %s already exists", path)
+	}
+
+	kf := keyFile{
+		Version:   Version,
+		PublicKey: identity.PublicKey,
+		Salt:      make([]byte, SaltSize),
+		N:         ScryptN,
+		R:         ScryptR,
+		P:         ScryptP,
+		Nonce:     make([]byte, chacha20poly1305.NonceSizeX),
+	}
+
+	if _, err := rand.Read(kf.Salt); err != nil {
+		return err
+	}
+	if _, err := rand.Read(kf.Nonce); err != nil {
+		return err
+	}
+
+	suite, err := kf.cipherSuite(passphrase)
+	if err != nil {
+		return err
+	}
+
+	kf.Ciphertext = suite.Seal(nil, kf.Nonce, identity.PrivateKey, kf.PublicKey)
+
+	encoded, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, and sync it before renaming
+	// it, so that a crash or a power loss never leaves a truncated
+	// key file behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".identity-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads the identity stored at path and decrypts it
+// with the passphrase.
+func Load(path string, passphrase []byte) (Identity, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var kf keyFile
+	if err := json.Unmarshal(encoded, &kf); err != nil {
+		return Identity{}, ErrUnsupportedFormat
+	}
+
+	if kf.Version != Version || len(kf.Salt) != SaltSize ||
+		len(kf.Nonce) != chacha20poly1305.NonceSizeX {
+		return Identity{}, ErrUnsupportedFormat
+	}
+
+	suite, err := kf.cipherSuite(passphrase)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	privkey, err := suite.Open(nil, kf.Nonce, kf.Ciphertext, kf.PublicKey)
+	if err != nil {
+		return Identity{}, ErrInvalidPassphrase
+	}
+
+	return Identity{PrivateKey: privkey, PublicKey: kf.PublicKey}, nil
+}
+
+// LoadOrCreate loads the identity stored at path, or creates
+// a new one if the file does not exist yet.
+func LoadOrCreate(path string, passphrase []byte) (Identity, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return Create(path, passphrase)
+	}
+
+	return Load(path, passphrase)
+}
+
+func (kf keyFile) cipherSuite(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, kf.Salt, kf.N, kf.R, kf.P, KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.NewX(key)
+}
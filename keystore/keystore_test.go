@@ -0,0 +1,82 @@
+package keystore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "identity.json")
+
+	created, err := Create(path, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(created.PrivateKey, loaded.PrivateKey) {
+		t.Fatal("loaded private key is incorrect")
+	}
+	if !bytes.Equal(created.PublicKey, loaded.PublicKey) {
+		t.Fatal("loaded public key is incorrect")
+	}
+
+	if _, err := Create(path, []byte("hunter2")); err == nil {
+		t.Fatal("expected error when overwriting key file")
+	}
+}
+
+func TestLoad_InvalidPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "identity.json")
+
+	if _, err := Create(path, []byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path, []byte("hunter3")); err != ErrInvalidPassphrase {
+		t.Fatal("expected invalid passphrase error")
+	}
+}
+
+func TestLoadOrCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "identity.json")
+
+	first, err := LoadOrCreate(path, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := LoadOrCreate(path, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(first.PublicKey, second.PublicKey) {
+		t.Fatal("identity changed between sessions")
+	}
+}
@@ -4,21 +4,81 @@ import (
 	"bufio"
 	"encoding/base64"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+
+	"github.com/hasyimibhar/p2p-chat/keystore"
+	"github.com/hasyimibhar/p2p-chat/p2p"
+	"github.com/hasyimibhar/p2p-chat/transport"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 func main() {
 	var port = flag.Int("port", 8888, "Port to listen for peers")
-	var peer = flag.String("peer", "", "Peer to connect to")
+	var listen = flag.String("listen", "", "Address to listen for peers on (default localhost:<port>)")
+	var advertise = flag.String("advertise", "", "Address peers connect to (default the listen address)")
+	var peers peerList
+	flag.Var(&peers, "peer", "Peer to join the ring through (may be repeated)")
+	var bootstrap = flag.String("bootstrap", "", "Path to a file listing peers to join the ring through, one per line")
+	var knownPeers = flag.String("known-peers", "", "Path to the file caching the peers the node has seen")
+	var identity = flag.String("identity", "", "Path to the key file storing the node's identity")
+	var successors = flag.Int("successors", p2p.DefaultSuccessorListSize, "Number of successors to keep in the successor list")
 	flag.Parse()
 
-	node, err := NewNode(*port)
+	if *successors < 1 {
+		log.Println("[error] invalid successor list size:", *successors)
+		os.Exit(1)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+
+	listenAddr := *listen
+	if listenAddr == "" {
+		listenAddr = net.JoinHostPort("localhost", strconv.Itoa(*port))
+	}
+
+	advertiseAddr, err := advertisedAddr(listenAddr, *advertise)
+	if err != nil {
+		log.Println("[error] invalid advertised address:", err)
+		os.Exit(1)
+	}
+
+	config := p2p.DefaultConfig(advertiseAddr)
+	config.ListenAddr = listenAddr
+	config.SuccessorListSize = *successors
+	config.KnownPeersPath = *knownPeers
+	config.BootstrapPeers = peers
+
+	if *bootstrap != "" {
+		addresses, err := readPeerList(*bootstrap)
+		if err != nil {
+			log.Println("[error] failed to read bootstrap peers:", err)
+			os.Exit(1)
+		}
+
+		config.BootstrapPeers = append(config.BootstrapPeers, addresses...)
+	}
+
+	var node *p2p.Node
+
+	if *identity != "" {
+		var id keystore.Identity
+		id, err = loadIdentity(reader, *identity)
+		if err == nil {
+			node, err = p2p.NewNodeWithKey(config, id.PrivateKey, id.PublicKey)
+		}
+	} else {
+		node, err = p2p.NewNode(config)
+	}
 	if err != nil {
 		log.Println("[error] failed to start node:", err)
+		os.Exit(1)
 	}
 
 	log.Printf("[info] initialized node with public key %s",
@@ -26,11 +86,8 @@ func main() {
 
 	go node.ListenForConnections()
 
-	if *peer != "" {
-		if err := node.JoinPeer(*peer); err != nil {
-			log.Printf("[error] failed to join peer %s: %s", *peer, err)
-			os.Exit(1)
-		}
+	if err := node.Bootstrap(); err != nil {
+		log.Println("[warn] failed to join the ring, retrying in the background:", err)
 	}
 
 	go func() {
@@ -40,7 +97,12 @@ func main() {
 	}()
 
 	go func() {
-		reader := bufio.NewReader(os.Stdin)
+		for chat := range node.PrivateChats() {
+			log.Printf("[(private) %s] %s", base64.StdEncoding.EncodeToString(chat.PublicKey), chat.Text)
+		}
+	}()
+
+	go func() {
 		for {
 			msg, _ := reader.ReadString('\n')
 
@@ -94,7 +156,103 @@ func main() {
 	sig := <-sigs
 	log.Println("[info] received signal:", sig)
 
+	// Leave the ring gracefully, so that the node's neighbours
+	// don't have to wait for stabilization to notice
+	if err := node.Leave(); err != nil {
+		log.Println("[warn] failed to leave the ring gracefully:", err)
+	}
+
 	node.Close()
 
 	os.Exit(0)
 }
+
+// loadIdentity loads the node's identity from the key file at path,
+// creating it if it doesn't exist. The passphrase is read from the
+// P2P_CHAT_PASSPHRASE environment variable, or prompted for if the
+// variable is not set. The prompt doesn't echo the passphrase when
+// stdin is a terminal.
+func loadIdentity(reader *bufio.Reader, path string) (keystore.Identity, error) {
+	passphrase, ok := os.LookupEnv("P2P_CHAT_PASSPHRASE")
+	if !ok {
+		fmt.Fprint(os.Stderr, "Passphrase: ")
+
+		if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+			line, err := terminal.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return keystore.Identity{}, fmt.Errorf("failed to read passphrase: %s", err)
+			}
+
+			passphrase = string(line)
+		} else {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return keystore.Identity{}, fmt.Errorf("failed to read passphrase: %s", err)
+			}
+
+			passphrase = strings.TrimRight(line, "\r\n")
+		}
+	}
+
+	return keystore.LoadOrCreate(path, []byte(passphrase))
+}
+
+// advertisedAddr returns the address advertised to peers: advertise if
+// it's set, or else the listen address. Since peers can't connect to
+// an unspecified host, e.g. when listening on all interfaces, localhost
+// is advertised instead.
+func advertisedAddr(listen string, advertise string) (string, error) {
+	if advertise == "" {
+		host, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return "", err
+		}
+
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			log.Println("[warn] advertising localhost, so peers on other hosts can't connect; set -advertise")
+			host = "localhost"
+		}
+
+		advertise = net.JoinHostPort(host, port)
+	}
+
+	if err := (transport.TCP{}).CheckAddr(advertise, nil); err != nil {
+		return "", err
+	}
+
+	return advertise, nil
+}
+
+// peerList is a flag which can be repeated to list several peers.
+type peerList []string
+
+func (l *peerList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *peerList) Set(address string) error {
+	*l = append(*l, address)
+	return nil
+}
+
+// readPeerList reads the addresses listed in the file at path, one
+// per line. Blank lines and lines starting with # are ignored.
+func readPeerList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	addresses := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			addresses = append(addresses, line)
+		}
+	}
+
+	return addresses, scanner.Err()
+}
@@ -1,22 +1,77 @@
 package message
 
 import (
-	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"github.com/hasyimibhar/p2p-chat/ratchet"
 )
 
+// ChatNonceSize is the size of the random nonce of a chat message.
+const ChatNonceSize = 16
+
+// Chat is a public chat message. It's signed by its author, so that
+// peers relaying the message cannot spoof its sender or alter its text.
+// The signed nonce tells apart messages with the same author and text.
 type Chat struct {
 	PublicKey []byte
+	Nonce     []byte
 	Text      string
+	Signature []byte
+}
+
+func NewChat(privkey []byte, pubkey []byte, text string) (Chat, error) {
+	nonce := make([]byte, ChatNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return Chat{}, err
+	}
+
+	m := Chat{
+		PublicKey: pubkey,
+		Nonce:     nonce,
+		Text:      text,
+	}
+
+	sig, err := ed25519.Sign(privkey, pubkey, m.payload())
+	if err != nil {
+		return Chat{}, err
+	}
+
+	m.Signature = sig
+	return m, nil
+}
+
+// Verify checks that the message is signed by PublicKey.
+func (m Chat) Verify() error {
+	return ed25519.Verify(m.PublicKey, m.payload(), m.Signature)
+}
+
+func (m Chat) payload() []byte {
+	payload := append(append([]byte{}, m.PublicKey...), m.Nonce...)
+	return append(payload, []byte(m.Text)...)
 }
 
 func (m Chat) Encode() ([]byte, error) {
-	return append(m.PublicKey, []byte(m.Text)...), nil
+	encoded := append([]byte{}, m.PublicKey...)
+	encoded = append(encoded, m.Nonce...)
+	encoded = append(encoded, m.Signature...)
+	return append(encoded, []byte(m.Text)...), nil
 }
 
 func (m Chat) Decode(buf []byte) (Message, error) {
-	return Chat{PublicKey: buf[:32], Text: string(buf[32:])}, nil
+	if err := checkLength(buf, 32+ChatNonceSize+64); err != nil {
+		return nil, err
+	}
+
+	return Chat{
+		PublicKey: buf[:32],
+		Nonce:     buf[32 : 32+ChatNonceSize],
+		Signature: buf[32+ChatNonceSize : 96+ChatNonceSize],
+		Text:      string(buf[96+ChatNonceSize:]),
+	}, nil
 }
 
 // ChatLogRequest asks a peer for its chat log.
@@ -37,6 +92,11 @@ type ChatLog struct {
 }
 
 func (m ChatLog) Encode() ([]byte, error) {
+	if len(m.Entries) > math.MaxUint16 {
+		return nil, fmt.Errorf("chat log has %d entries, at most %d can be encoded",
+			len(m.Entries), math.MaxUint16)
+	}
+
 	encoded := make([]byte, 2)
 	binary.BigEndian.PutUint16(encoded, uint16(len(m.Entries)))
 
@@ -56,13 +116,25 @@ func (m ChatLog) Decode(buf []byte) (Message, error) {
 		Entries: []Chat{},
 	}
 
+	if err := checkLength(buf, 2); err != nil {
+		return nil, err
+	}
+
 	entriesLength := binary.BigEndian.Uint16(buf)
 	buf = buf[2:]
 
 	for i := uint16(0); i < entriesLength; i++ {
+		if err := checkLength(buf, 4); err != nil {
+			return nil, err
+		}
+
 		buflen := binary.BigEndian.Uint32(buf)
 		buf = buf[4:]
 
+		if uint64(buflen) > uint64(len(buf)) {
+			return nil, ErrMessageTooShort
+		}
+
 		entry, err := Chat{}.Decode(buf[:buflen])
 		if err != nil {
 			return nil, err
@@ -72,70 +144,98 @@ func (m ChatLog) Decode(buf []byte) (Message, error) {
 		buf = buf[buflen:]
 	}
 
+	if len(buf) != 0 {
+		return nil, ErrInvalidMessageLength
+	}
+
 	return decoded, nil
 }
 
 // StartPrivateChatRequest informs the peer with the specified public key
-// that the node wants to start exchanging private messages.
+// that the node wants to start exchanging private messages. The recipient
+// connects back to Sender, and expects it to identify itself with SenderKey.
+// RatchetKey is the sender's initial ratchet public key.
 type StartPrivateChatRequest struct {
-	Sender    string
-	PublicKey []byte
+	Sender     string
+	SenderKey  []byte
+	PublicKey  []byte
+	RatchetKey []byte
 }
 
 func (m StartPrivateChatRequest) Encode() ([]byte, error) {
-	return append(m.PublicKey, []byte(m.Sender)...), nil
+	encoded := append([]byte{}, m.PublicKey...)
+	encoded = append(encoded, m.SenderKey...)
+	encoded = append(encoded, m.RatchetKey...)
+	return append(encoded, []byte(m.Sender)...), nil
 }
 
 func (m StartPrivateChatRequest) Decode(buf []byte) (Message, error) {
-	return StartPrivateChatRequest{PublicKey: buf[:32], Sender: string(buf[32:])}, nil
+	if err := checkLength(buf, 96); err != nil {
+		return nil, err
+	}
+
+	return StartPrivateChatRequest{
+		PublicKey:  buf[:32],
+		SenderKey:  buf[32:64],
+		RatchetKey: buf[64:96],
+		Sender:     string(buf[96:]),
+	}, nil
 }
 
 // StartPrivateChatResponse is a response of StartPrivateChatRequest.
-type StartPrivateChatResponse struct{}
+// RatchetKey is the recipient's initial ratchet public key.
+type StartPrivateChatResponse struct {
+	RatchetKey []byte
+}
 
 func (m StartPrivateChatResponse) Encode() ([]byte, error) {
-	return []byte{}, nil
+	return m.RatchetKey, nil
 }
 
 func (m StartPrivateChatResponse) Decode(buf []byte) (Message, error) {
-	return StartPrivateChatResponse{}, nil
+	if len(buf) != 32 {
+		return nil, ErrInvalidMessageLength
+	}
+
+	return StartPrivateChatResponse{RatchetKey: buf}, nil
 }
 
+// PrivateChat is a private chat message, encrypted end-to-end with the
+// Double Ratchet session shared by Sender and the recipient (PublicKey).
 type PrivateChat struct {
 	Sender     []byte
 	PublicKey  []byte
-	Nonce      []byte
+	Header     ratchet.Header
 	Ciphertext []byte
 }
 
-func NewPrivateChat(nodePubkey []byte, pubkey []byte, text string, suite cipher.AEAD) (PrivateChat, error) {
-	nonce := make([]byte, NonceSize)
-	if _, err := rand.Read(nonce); err != nil {
-		return PrivateChat{}, err
-	}
-
-	ciphertext := suite.Seal(nil, nonce, []byte(text), nil)
-	return PrivateChat{Sender: nodePubkey, PublicKey: pubkey, Nonce: nonce, Ciphertext: ciphertext}, nil
-}
-
-func (m PrivateChat) Decrypt(suite cipher.AEAD) (string, error) {
-	plaintext, err := suite.Open(nil, m.Nonce, m.Ciphertext, nil)
-	if err != nil {
-		return "", err
-	}
-
-	return string(plaintext), nil
+// AssociatedData returns the data authenticated along with the
+// ciphertext, which binds the message to its sender and recipient.
+func (m PrivateChat) AssociatedData() []byte {
+	return append(append([]byte{}, m.Sender...), m.PublicKey...)
 }
 
 func (m PrivateChat) Encode() ([]byte, error) {
-	return append(m.Sender, append(m.PublicKey, append(m.Nonce, m.Ciphertext...)...)...), nil
+	encoded := append([]byte{}, m.Sender...)
+	encoded = append(encoded, m.PublicKey...)
+	encoded = append(encoded, m.Header.Encode()...)
+	return append(encoded, m.Ciphertext...), nil
 }
 
 func (m PrivateChat) Decode(buf []byte) (Message, error) {
+	if err := checkLength(buf, 64+ratchet.HeaderSize); err != nil {
+		return nil, err
+	}
+
+	header, err := ratchet.DecodeHeader(buf[64 : 64+ratchet.HeaderSize])
+	if err != nil {
+		return nil, err
+	}
+
 	return PrivateChat{
 		Sender:     buf[:32],
 		PublicKey:  buf[32:64],
-		Nonce:      buf[64:88],
-		Ciphertext: buf[88:],
+		Header:     header,
+		Ciphertext: buf[64+ratchet.HeaderSize:],
 	}, nil
 }
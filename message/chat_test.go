@@ -8,10 +8,10 @@ import (
 )
 
 func TestChat_EncodeDecode(t *testing.T) {
-	_, pub, _ := ed25519.GenerateKey()
-	msg := Chat{
-		PublicKey: pub,
-		Text:      "lorem ipsum dolor sit amet",
+	priv, pub, _ := ed25519.GenerateKey()
+	msg, err := NewChat(priv, pub, "lorem ipsum dolor sit amet")
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	encoded, err := msg.Encode()
@@ -19,7 +19,9 @@ func TestChat_EncodeDecode(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !bytes.Equal(encoded, append(pub, []byte("lorem ipsum dolor sit amet")...)) {
+	expected := append(append([]byte{}, pub...), msg.Nonce...)
+	expected = append(expected, msg.Signature...)
+	if !bytes.Equal(encoded, append(expected, []byte("lorem ipsum dolor sit amet")...)) {
 		t.Fatal("encoded message is incorrect")
 	}
 
@@ -36,7 +38,94 @@ func TestChat_EncodeDecode(t *testing.T) {
 	if !bytes.Equal(chat.PublicKey, pub) {
 		t.Fatal("decoded message is incorrect")
 	}
+	if !bytes.Equal(chat.Nonce, msg.Nonce) {
+		t.Fatal("decoded message is incorrect")
+	}
 	if chat.Text != "lorem ipsum dolor sit amet" {
 		t.Fatal("decoded message is incorrect")
 	}
+	if err := chat.Verify(); err != nil {
+		t.Fatal("decoded message signature is invalid")
+	}
+}
+
+func TestChat_VerifySpoofed(t *testing.T) {
+	priv, pub, _ := ed25519.GenerateKey()
+	_, other, _ := ed25519.GenerateKey()
+
+	msg, _ := NewChat(priv, pub, "lorem ipsum dolor sit amet")
+
+	spoofed := msg
+	spoofed.PublicKey = other
+	if err := spoofed.Verify(); err == nil {
+		t.Fatal("expected invalid signature")
+	}
+
+	altered := msg
+	altered.Text = "dolor sit amet"
+	if err := altered.Verify(); err == nil {
+		t.Fatal("expected invalid signature")
+	}
+
+	renonced := msg
+	renonced.Nonce = make([]byte, ChatNonceSize)
+	if err := renonced.Verify(); err == nil {
+		t.Fatal("expected invalid signature")
+	}
+}
+
+func TestNewChat_DistinctNonces(t *testing.T) {
+	priv, pub, _ := ed25519.GenerateKey()
+
+	chat1, _ := NewChat(priv, pub, "lorem ipsum")
+	chat2, _ := NewChat(priv, pub, "lorem ipsum")
+
+	if bytes.Equal(chat1.Nonce, chat2.Nonce) {
+		t.Fatal("identical messages share a nonce")
+	}
+	if bytes.Equal(chat1.Signature, chat2.Signature) {
+		t.Fatal("identical messages share a signature")
+	}
+}
+
+func TestChatLog_EncodeDecode(t *testing.T) {
+	priv, pub, _ := ed25519.GenerateKey()
+
+	chat1, _ := NewChat(priv, pub, "lorem ipsum")
+	chat2, _ := NewChat(priv, pub, "dolor sit amet")
+
+	encoded, err := ChatLog{Entries: []Chat{chat1, chat2}}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := ChatLog{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chatLog, ok := decoded.(ChatLog)
+	if !ok {
+		t.Fatal("wrong message type")
+	}
+
+	if len(chatLog.Entries) != 2 {
+		t.Fatal("decoded message is incorrect")
+	}
+
+	for i, e := range chatLog.Entries {
+		if e.Text != []Chat{chat1, chat2}[i].Text {
+			t.Fatal("decoded message is incorrect")
+		}
+		if err := e.Verify(); err != nil {
+			t.Fatal("decoded entry signature is invalid")
+		}
+	}
+}
+
+func TestChatLog_TooManyEntries(t *testing.T) {
+	chatLog := ChatLog{Entries: make([]Chat, 1<<16)}
+	if _, err := chatLog.Encode(); err == nil {
+		t.Fatal("expected error for too many entries")
+	}
 }
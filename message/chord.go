@@ -15,6 +15,17 @@ func (m Ping) Decode(buf []byte) (Message, error) {
 	return Ping{}, nil
 }
 
+// Pong is the response of Ping.
+type Pong struct{}
+
+func (m Pong) Encode() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (m Pong) Decode(buf []byte) (Message, error) {
+	return Pong{}, nil
+}
+
 // Notify notifies a peer to set the caller's
 // node as its predecessor.
 type Notify struct {
@@ -40,59 +51,300 @@ func (m StabilizeRequest) Decode(buf []byte) (Message, error) {
 	return StabilizeRequest{}, nil
 }
 
-// StabilizeResponse is the response of StabilizeRequest.
+// StabilizeResponse is the response of StabilizeRequest. Predecessor
+// and PublicKey are empty if the peer has no predecessor.
 type StabilizeResponse struct {
 	Predecessor string
+	PublicKey   []byte
 }
 
 func (m StabilizeResponse) Encode() ([]byte, error) {
-	return []byte(m.Predecessor), nil
+	if m.Predecessor == "" {
+		return []byte{}, nil
+	}
+
+	return append(append([]byte{}, m.PublicKey...), []byte(m.Predecessor)...), nil
 }
 
 func (m StabilizeResponse) Decode(buf []byte) (Message, error) {
-	return StabilizeResponse{Predecessor: string(buf)}, nil
+	if len(buf) == 0 {
+		return StabilizeResponse{}, nil
+	}
+
+	if err := checkLength(buf, 33); err != nil {
+		return nil, err
+	}
+
+	return StabilizeResponse{
+		PublicKey:   buf[:32],
+		Predecessor: string(buf[32:]),
+	}, nil
 }
 
-// SuccessorRequest is sent by a peer to request another peer
-// to return its successor. It's used to populate a peer's
-// successor list.
-type SuccessorRequest struct {
-	Count     int
+// FindSuccessorRequest asks a peer for the successor of an ID. If
+// AvoidFingers is true, the peer must route the lookup through its
+// successor rather than its finger table, e.g. because the finger it
+// returned previously is unreachable.
+type FindSuccessorRequest struct {
+	ID           []byte
+	AvoidFingers bool
+}
+
+func (m FindSuccessorRequest) Encode() ([]byte, error) {
+	encoded := append([]byte{}, m.ID...)
+	if m.AvoidFingers {
+		return append(encoded, 1), nil
+	}
+
+	return append(encoded, 0), nil
+}
+
+func (m FindSuccessorRequest) Decode(buf []byte) (Message, error) {
+	if len(buf) != 33 {
+		return nil, ErrInvalidMessageLength
+	}
+
+	return FindSuccessorRequest{
+		ID:           buf[:32],
+		AvoidFingers: buf[32] == 1,
+	}, nil
+}
+
+// FindSuccessorResponse is the response of FindSuccessorRequest. If Found
+// is true, the peer at Addr is the successor of the ID. Otherwise, the
+// lookup must continue at the peer at Addr, which is closer to the ID.
+type FindSuccessorResponse struct {
+	Found     bool
 	PublicKey []byte
-	Sender    string
+	Addr      string
+}
+
+func (m FindSuccessorResponse) Encode() ([]byte, error) {
+	encoded := []byte{0}
+	if m.Found {
+		encoded[0] = 1
+	}
+
+	encoded = append(encoded, m.PublicKey...)
+	return append(encoded, []byte(m.Addr)...), nil
+}
+
+func (m FindSuccessorResponse) Decode(buf []byte) (Message, error) {
+	if err := checkLength(buf, 34); err != nil {
+		return nil, err
+	}
+
+	return FindSuccessorResponse{
+		Found:     buf[0] == 1,
+		PublicKey: buf[1:33],
+		Addr:      string(buf[33:]),
+	}, nil
+}
+
+// SuccessorRequest asks a peer for its successor list, i.e. its
+// successor followed by the successors of its successor, with at most
+// Count entries. It's used to populate a peer's successor list in
+// a single round trip.
+type SuccessorRequest struct {
+	Count int
 }
 
 func (m SuccessorRequest) Encode() ([]byte, error) {
 	encoded := make([]byte, 4)
 	binary.BigEndian.PutUint32(encoded, uint32(m.Count))
 
-	return append(encoded, append(m.PublicKey, []byte(m.Sender)...)...), nil
+	return encoded, nil
 }
 
 func (m SuccessorRequest) Decode(buf []byte) (Message, error) {
+	if len(buf) != 4 {
+		return nil, ErrInvalidMessageLength
+	}
+
 	return SuccessorRequest{
-		Count:     int(binary.BigEndian.Uint32(buf[:4])),
-		PublicKey: buf[4:36],
-		Sender:    string(buf[36:]),
+		Count: int(binary.BigEndian.Uint32(buf)),
 	}, nil
 }
 
+// SuccessorEntry is an entry of a successor list.
+type SuccessorEntry struct {
+	PublicKey []byte
+	Addr      string
+}
+
 // SuccessorResponse is the response of SuccessorRequest.
 type SuccessorResponse struct {
-	Count     int
-	Successor string
+	Successors []SuccessorEntry
 }
 
 func (m SuccessorResponse) Encode() ([]byte, error) {
-	encoded := make([]byte, 4)
-	binary.BigEndian.PutUint32(encoded, uint32(m.Count))
-
-	return append(encoded, []byte(m.Successor)...), nil
+	return appendSuccessors([]byte{}, m.Successors), nil
 }
 
 func (m SuccessorResponse) Decode(buf []byte) (Message, error) {
-	return SuccessorResponse{
-		Count:     int(binary.BigEndian.Uint32(buf[:4])),
-		Successor: string(buf[4:]),
+	successors, buf, err := readSuccessors(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) != 0 {
+		return nil, ErrInvalidMessageLength
+	}
+
+	return SuccessorResponse{Successors: successors}, nil
+}
+
+// Leave is sent by a node which is leaving the ring to its predecessor
+// and successor, so that they can splice it out of the ring. The
+// predecessor takes Successor as its successor and Successors as its
+// successor list, while the successor takes Predecessor as its
+// predecessor. Predecessor and PredecessorKey are empty if the
+// leaving node has no predecessor.
+type Leave struct {
+	Predecessor    string
+	PredecessorKey []byte
+	Successor      string
+	SuccessorKey   []byte
+	Successors     []SuccessorEntry
+}
+
+func (m Leave) Encode() ([]byte, error) {
+	encoded := appendField([]byte{}, []byte(m.Predecessor))
+	encoded = appendField(encoded, m.PredecessorKey)
+	encoded = appendField(encoded, []byte(m.Successor))
+	encoded = appendField(encoded, m.SuccessorKey)
+
+	return appendSuccessors(encoded, m.Successors), nil
+}
+
+func (m Leave) Decode(buf []byte) (Message, error) {
+	fields := make([][]byte, 4)
+	for i := range fields {
+		var err error
+		if fields[i], buf, err = readField(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	if (len(fields[1]) != 0 && len(fields[1]) != 32) || len(fields[3]) != 32 {
+		return nil, ErrInvalidMessageLength
+	}
+
+	successors, buf, err := readSuccessors(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) != 0 {
+		return nil, ErrInvalidMessageLength
+	}
+
+	return Leave{
+		Predecessor:    string(fields[0]),
+		PredecessorKey: fields[1],
+		Successor:      string(fields[2]),
+		SuccessorKey:   fields[3],
+		Successors:     successors,
+	}, nil
+}
+
+// appendSuccessors appends the successor list to buf,
+// prefixed by the number of entries.
+func appendSuccessors(buf []byte, successors []SuccessorEntry) []byte {
+	count := make([]byte, 2)
+	binary.BigEndian.PutUint16(count, uint16(len(successors)))
+	buf = append(buf, count...)
+
+	for _, s := range successors {
+		buf = appendField(buf, s.PublicKey)
+		buf = appendField(buf, []byte(s.Addr))
+	}
+
+	return buf
+}
+
+// readSuccessors reads a successor list from buf,
+// and returns the rest of buf.
+func readSuccessors(buf []byte) ([]SuccessorEntry, []byte, error) {
+	if err := checkLength(buf, 2); err != nil {
+		return nil, nil, err
+	}
+
+	count := binary.BigEndian.Uint16(buf)
+	buf = buf[2:]
+
+	successors := []SuccessorEntry{}
+	for i := uint16(0); i < count; i++ {
+		var key, addr []byte
+		var err error
+
+		if key, buf, err = readField(buf); err != nil {
+			return nil, nil, err
+		}
+
+		if len(key) != 32 {
+			return nil, nil, ErrInvalidMessageLength
+		}
+
+		if addr, buf, err = readField(buf); err != nil {
+			return nil, nil, err
+		}
+
+		successors = append(successors, SuccessorEntry{PublicKey: key, Addr: string(addr)})
+	}
+
+	return successors, buf, nil
+}
+
+// appendField appends the field to buf, prefixed by its length.
+func appendField(buf []byte, field []byte) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(field)))
+
+	return append(append(buf, length...), field...)
+}
+
+// readField reads a field prefixed by its length from buf,
+// and returns the rest of buf.
+func readField(buf []byte) ([]byte, []byte, error) {
+	if err := checkLength(buf, 2); err != nil {
+		return nil, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(buf))
+	buf = buf[2:]
+
+	if err := checkLength(buf, length); err != nil {
+		return nil, nil, err
+	}
+
+	return buf[:length], buf[length:], nil
+}
+
+// Merge is passed around a ring which has found out that another ring
+// exists, e.g. after a partition has healed. Each peer looks up its
+// successor in the other ring through the peer at Contact, and switches
+// to it if it's closer than its current successor. Initiator is the
+// public key of the peer which started the merge.
+type Merge struct {
+	Initiator  []byte
+	ContactKey []byte
+	Contact    string
+}
+
+func (m Merge) Encode() ([]byte, error) {
+	encoded := append(append([]byte{}, m.Initiator...), m.ContactKey...)
+	return append(encoded, []byte(m.Contact)...), nil
+}
+
+func (m Merge) Decode(buf []byte) (Message, error) {
+	if err := checkLength(buf, 64); err != nil {
+		return nil, err
+	}
+
+	return Merge{
+		Initiator:  buf[:32],
+		ContactKey: buf[32:64],
+		Contact:    string(buf[64:]),
 	}, nil
 }
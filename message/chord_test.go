@@ -60,6 +60,7 @@ func TestStabilizeRequest_EncodeDecode(t *testing.T) {
 func TestStabilizeResponse_EncodeDecode(t *testing.T) {
 	msg := StabilizeResponse{
 		Predecessor: "localhost:4321",
+		PublicKey:   bytes.Repeat([]byte{1}, 32),
 	}
 
 	encoded, err := msg.Encode()
@@ -67,10 +68,6 @@ func TestStabilizeResponse_EncodeDecode(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !bytes.Equal(encoded, []byte("localhost:4321")) {
-		t.Fatal("encoded message is incorrect")
-	}
-
 	decoded, err := StabilizeResponse{}.Decode(encoded)
 	if err != nil {
 		t.Fatal(err)
@@ -81,7 +78,151 @@ func TestStabilizeResponse_EncodeDecode(t *testing.T) {
 		t.Fatal("wrong message type")
 	}
 
-	if notify.Predecessor != "localhost:4321" {
+	if notify.Predecessor != "localhost:4321" || !bytes.Equal(notify.PublicKey, msg.PublicKey) {
+		t.Fatal("decoded message is incorrect")
+	}
+
+	// No predecessor
+	encoded, _ = StabilizeResponse{}.Encode()
+	decoded, err = StabilizeResponse{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.(StabilizeResponse).Predecessor != "" {
+		t.Fatal("decoded message is incorrect")
+	}
+}
+
+func TestFindSuccessorResponse_EncodeDecode(t *testing.T) {
+	for _, found := range []bool{true, false} {
+		msg := FindSuccessorResponse{
+			Found:     found,
+			PublicKey: bytes.Repeat([]byte{1}, 32),
+			Addr:      "localhost:4321",
+		}
+
+		encoded, _ := msg.Encode()
+		decoded, err := FindSuccessorResponse{}.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response := decoded.(FindSuccessorResponse)
+		if response.Found != found || response.Addr != msg.Addr || !bytes.Equal(response.PublicKey, msg.PublicKey) {
+			t.Fatal("decoded message is incorrect")
+		}
+	}
+}
+
+func TestSuccessorResponse_EncodeDecode(t *testing.T) {
+	msg := SuccessorResponse{
+		Successors: []SuccessorEntry{
+			{PublicKey: bytes.Repeat([]byte{1}, 32), Addr: "localhost:8001"},
+			{PublicKey: bytes.Repeat([]byte{2}, 32), Addr: "localhost:8002"},
+		},
+	}
+
+	encoded, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := SuccessorResponse{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := decoded.(SuccessorResponse)
+	if len(response.Successors) != 2 {
+		t.Fatal("decoded message is incorrect")
+	}
+
+	for i, s := range response.Successors {
+		if s.Addr != msg.Successors[i].Addr || !bytes.Equal(s.PublicKey, msg.Successors[i].PublicKey) {
+			t.Fatal("decoded message is incorrect")
+		}
+	}
+
+	if _, err := (SuccessorResponse{}).Decode(encoded[:len(encoded)-1]); err == nil {
+		t.Fatal("expected truncated message to be rejected")
+	}
+}
+
+func TestLeave_EncodeDecode(t *testing.T) {
+	msg := Leave{
+		Predecessor:    "localhost:8001",
+		PredecessorKey: bytes.Repeat([]byte{1}, 32),
+		Successor:      "localhost:8002",
+		SuccessorKey:   bytes.Repeat([]byte{2}, 32),
+		Successors: []SuccessorEntry{
+			{PublicKey: bytes.Repeat([]byte{3}, 32), Addr: "localhost:8003"},
+			{PublicKey: bytes.Repeat([]byte{4}, 32), Addr: "localhost:8004"},
+		},
+	}
+
+	encoded, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Leave{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leave, ok := decoded.(Leave)
+	if !ok {
+		t.Fatal("wrong message type")
+	}
+
+	if leave.Predecessor != msg.Predecessor || !bytes.Equal(leave.PredecessorKey, msg.PredecessorKey) ||
+		leave.Successor != msg.Successor || !bytes.Equal(leave.SuccessorKey, msg.SuccessorKey) ||
+		len(leave.Successors) != 2 || leave.Successors[1].Addr != "localhost:8004" {
+		t.Fatal("decoded message is incorrect")
+	}
+
+	// Without a predecessor
+	msg.Predecessor, msg.PredecessorKey = "", nil
+
+	encoded, err = msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (Leave{}).Decode(encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (Leave{}).Decode(encoded[:len(encoded)-1]); err == nil {
+		t.Fatal("truncated message was decoded")
+	}
+}
+
+func TestMerge_EncodeDecode(t *testing.T) {
+	msg := Merge{
+		Initiator:  bytes.Repeat([]byte{1}, 32),
+		ContactKey: bytes.Repeat([]byte{2}, 32),
+		Contact:    "localhost:8001",
+	}
+
+	encoded, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Merge{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merge, ok := decoded.(Merge)
+	if !ok {
+		t.Fatal("wrong message type")
+	}
+
+	if !bytes.Equal(merge.Initiator, msg.Initiator) || !bytes.Equal(merge.ContactKey, msg.ContactKey) ||
+		merge.Contact != msg.Contact {
 		t.Fatal("decoded message is incorrect")
 	}
 }
@@ -0,0 +1,122 @@
+package message
+
+import (
+	"encoding/binary"
+)
+
+// StoreRequest asks the peer responsible for a key to store its value.
+// Key is the ID of the key on the ring.
+type StoreRequest struct {
+	Key   []byte
+	Value []byte
+}
+
+func (m StoreRequest) Encode() ([]byte, error) {
+	return append(append([]byte{}, m.Key...), m.Value...), nil
+}
+
+func (m StoreRequest) Decode(buf []byte) (Message, error) {
+	if err := checkLength(buf, 32); err != nil {
+		return nil, err
+	}
+
+	return StoreRequest{
+		Key:   buf[:32],
+		Value: buf[32:],
+	}, nil
+}
+
+// StoreResponse is the response of StoreRequest. Stored is false
+// if the peer has no room left for the value.
+type StoreResponse struct {
+	Stored bool
+}
+
+func (m StoreResponse) Encode() ([]byte, error) {
+	encoded := []byte{0}
+	if m.Stored {
+		encoded[0] = 1
+	}
+
+	return encoded, nil
+}
+
+func (m StoreResponse) Decode(buf []byte) (Message, error) {
+	if len(buf) != 1 {
+		return nil, ErrInvalidMessageLength
+	}
+
+	return StoreResponse{Stored: buf[0] == 1}, nil
+}
+
+// Replicate stores a copy of a value on the peer. If Count is greater
+// than zero, the peer passes it on to its successor with Count
+// decremented, so that the value is stored on Count more successors.
+type Replicate struct {
+	Count int
+	Key   []byte
+	Value []byte
+}
+
+func (m Replicate) Encode() ([]byte, error) {
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, uint32(m.Count))
+
+	return append(append(encoded, m.Key...), m.Value...), nil
+}
+
+func (m Replicate) Decode(buf []byte) (Message, error) {
+	if err := checkLength(buf, 36); err != nil {
+		return nil, err
+	}
+
+	return Replicate{
+		Count: int(binary.BigEndian.Uint32(buf[:4])),
+		Key:   buf[4:36],
+		Value: buf[36:],
+	}, nil
+}
+
+// FetchRequest asks the peer responsible for a key for its value.
+type FetchRequest struct {
+	Key []byte
+}
+
+func (m FetchRequest) Encode() ([]byte, error) {
+	return m.Key, nil
+}
+
+func (m FetchRequest) Decode(buf []byte) (Message, error) {
+	if len(buf) != 32 {
+		return nil, ErrInvalidMessageLength
+	}
+
+	return FetchRequest{Key: buf}, nil
+}
+
+// FetchResponse is the response of FetchRequest. Found is false
+// if the peer doesn't store a value for the key.
+type FetchResponse struct {
+	Found bool
+	Value []byte
+}
+
+func (m FetchResponse) Encode() ([]byte, error) {
+	encoded := []byte{0}
+	if m.Found {
+		encoded[0] = 1
+	}
+
+	return append(encoded, m.Value...), nil
+}
+
+func (m FetchResponse) Decode(buf []byte) (Message, error) {
+	if err := checkLength(buf, 1); err != nil {
+		return nil, err
+	}
+
+	return FetchResponse{
+		Found: buf[0] == 1,
+		Value: buf[1:],
+	}, nil
+}
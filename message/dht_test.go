@@ -0,0 +1,113 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStoreRequest_EncodeDecode(t *testing.T) {
+	msg := StoreRequest{
+		Key:   bytes.Repeat([]byte{1}, 32),
+		Value: []byte("lorem ipsum"),
+	}
+
+	encoded, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := StoreRequest{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, ok := decoded.(StoreRequest)
+	if !ok {
+		t.Fatal("wrong message type")
+	}
+
+	if !bytes.Equal(request.Key, msg.Key) || !bytes.Equal(request.Value, msg.Value) {
+		t.Fatal("decoded message is incorrect")
+	}
+}
+
+func TestReplicate_EncodeDecode(t *testing.T) {
+	msg := Replicate{
+		Count: 3,
+		Key:   bytes.Repeat([]byte{1}, 32),
+		Value: []byte("lorem ipsum"),
+	}
+
+	encoded, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Replicate{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicate, ok := decoded.(Replicate)
+	if !ok {
+		t.Fatal("wrong message type")
+	}
+
+	if replicate.Count != 3 || !bytes.Equal(replicate.Key, msg.Key) || !bytes.Equal(replicate.Value, msg.Value) {
+		t.Fatal("decoded message is incorrect")
+	}
+}
+
+func TestStoreResponse_EncodeDecode(t *testing.T) {
+	for _, msg := range []StoreResponse{{Stored: true}, {Stored: false}} {
+		encoded, err := msg.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := StoreResponse{}.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.(StoreResponse) != msg {
+			t.Fatal("decoded message is incorrect")
+		}
+	}
+
+	if _, err := (StoreResponse{}).Decode([]byte{}); err != ErrInvalidMessageLength {
+		t.Fatal("expected invalid message length")
+	}
+}
+
+func TestFetchResponse_EncodeDecode(t *testing.T) {
+	for _, msg := range []FetchResponse{
+		{Found: true, Value: []byte("lorem ipsum")},
+		{Found: false, Value: []byte{}},
+	} {
+		encoded, err := msg.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := FetchResponse{}.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, ok := decoded.(FetchResponse)
+		if !ok {
+			t.Fatal("wrong message type")
+		}
+
+		if response.Found != msg.Found || !bytes.Equal(response.Value, msg.Value) {
+			t.Fatal("decoded message is incorrect")
+		}
+	}
+}
+
+func TestFetchRequest_InvalidLength(t *testing.T) {
+	if _, err := (FetchRequest{}).Decode(make([]byte, 31)); err != ErrInvalidMessageLength {
+		t.Fatal("expected invalid message length")
+	}
+}
@@ -0,0 +1,184 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// FrameVersion is the version of the frame format.
+	FrameVersion = 1
+
+	// FrameHeaderSize is the size of the frame header:
+	//
+	// - 1 byte: frame version
+	// - 1 byte: flags
+	// - 4 bytes: length of the frame body
+	//
+	FrameHeaderSize = 6
+
+	// SequenceSize is the size of the sequence number
+	// prepended to the body of encrypted frames.
+	SequenceSize = 8
+
+	// DefaultMaxFrameSize is the default limit on the size
+	// of the frame body.
+	DefaultMaxFrameSize = 1 << 20
+)
+
+// FrameFlags describes how the body of a frame is encoded.
+type FrameFlags byte
+
+const (
+	// FlagEncrypted is set if the frame body is encrypted.
+	FlagEncrypted FrameFlags = 1 << iota
+
+	// FlagRequest is set if the opcode is followed by a request
+	// header, i.e. if the message is a request or a response.
+	FlagRequest
+)
+
+var (
+	ErrUnsupportedVersion   = fmt.Errorf("unsupported frame version")
+	ErrUnexpectedEncryption = fmt.Errorf("frame encryption does not match the connection state")
+	ErrFrameTooLarge        = fmt.Errorf("frame exceeds maximum size")
+	ErrTruncatedFrame       = fmt.Errorf("connection closed in the middle of a frame")
+	ErrMalformedFrame       = fmt.Errorf("malformed frame")
+)
+
+// FrameHeader is the header of each frame sent over the wire. It's
+// authenticated as associated data of encrypted frames, so it cannot
+// be tampered with.
+type FrameHeader struct {
+	Version byte
+	Flags   FrameFlags
+	Length  uint32
+}
+
+// Encrypted returns true if the frame body is encrypted.
+func (h FrameHeader) Encrypted() bool {
+	return h.Flags&FlagEncrypted != 0
+}
+
+// Request returns true if the frame carries a request header.
+func (h FrameHeader) Request() bool {
+	return h.Flags&FlagRequest != 0
+}
+
+func (h FrameHeader) Encode() []byte {
+	encoded := make([]byte, FrameHeaderSize)
+	encoded[0] = h.Version
+	encoded[1] = byte(h.Flags)
+	binary.BigEndian.PutUint32(encoded[2:], h.Length)
+	return encoded
+}
+
+// DecodeFrameHeader decodes a frame header, and checks that its
+// version is supported.
+func DecodeFrameHeader(buf []byte) (FrameHeader, error) {
+	if len(buf) < FrameHeaderSize {
+		return FrameHeader{}, ErrMalformedFrame
+	}
+
+	h := FrameHeader{
+		Version: buf[0],
+		Flags:   FrameFlags(buf[1]),
+		Length:  binary.BigEndian.Uint32(buf[2:]),
+	}
+
+	if h.Version != FrameVersion {
+		return FrameHeader{}, ErrUnsupportedVersion
+	}
+
+	return h, nil
+}
+
+// FrameReader reads frames from a stream, e.g. a TCP connection.
+// It handles short reads, and refuses frames larger than the
+// maximum size before allocating memory for them.
+type FrameReader struct {
+	r       io.Reader
+	maxSize uint32
+}
+
+// NewFrameReader creates a FrameReader which reads frames whose
+// body is at most maxSize bytes.
+func NewFrameReader(r io.Reader, maxSize uint32) *FrameReader {
+	return &FrameReader{
+		r:       r,
+		maxSize: maxSize,
+	}
+}
+
+// ReadFrame reads the next frame, and returns its header along with
+// the whole frame (header included), ready to be passed to Decode.
+// It returns io.EOF if the stream ends cleanly between two frames,
+// and ErrTruncatedFrame if it ends in the middle of one.
+func (r *FrameReader) ReadFrame() (FrameHeader, []byte, error) {
+	headerbuf := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r.r, headerbuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return FrameHeader{}, nil, ErrTruncatedFrame
+		}
+		return FrameHeader{}, nil, err
+	}
+
+	header, err := DecodeFrameHeader(headerbuf)
+	if err != nil {
+		return FrameHeader{}, nil, err
+	}
+
+	if header.Length > r.maxSize {
+		return FrameHeader{}, nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, FrameHeaderSize+int(header.Length))
+	copy(frame, headerbuf)
+
+	if _, err := io.ReadFull(r.r, frame[FrameHeaderSize:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return FrameHeader{}, nil, ErrTruncatedFrame
+		}
+		return FrameHeader{}, nil, err
+	}
+
+	return header, frame, nil
+}
+
+// FrameWriter writes frames to a stream. It refuses to write frames
+// which the other side would reject for being too large.
+type FrameWriter struct {
+	w       io.Writer
+	maxSize uint32
+}
+
+// NewFrameWriter creates a FrameWriter which writes frames whose
+// body is at most maxSize bytes.
+func NewFrameWriter(w io.Writer, maxSize uint32) *FrameWriter {
+	return &FrameWriter{
+		w:       w,
+		maxSize: maxSize,
+	}
+}
+
+// WriteFrame writes a whole frame, as returned by Encode.
+func (w *FrameWriter) WriteFrame(frame []byte) error {
+	header, err := DecodeFrameHeader(frame)
+	if err != nil {
+		return err
+	}
+
+	if header.Length > w.maxSize {
+		return ErrFrameTooLarge
+	}
+
+	if uint32(len(frame)-FrameHeaderSize) != header.Length {
+		return ErrMalformedFrame
+	}
+
+	// Write returns an error if the frame is not written
+	// entirely, so there's no need to loop.
+	_, err = w.w.Write(frame)
+	return err
+}
@@ -0,0 +1,81 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameReader_ShortReads(t *testing.T) {
+	first, _ := Encode(Notify{Predecessor: "localhost:5432"}, nil, 0)
+	second, _ := Encode(Ping{}, nil, 0)
+
+	stream := append(append([]byte{}, first...), second...)
+	r := NewFrameReader(iotest.OneByteReader(bytes.NewReader(stream)), DefaultMaxFrameSize)
+
+	for _, expected := range [][]byte{first, second} {
+		_, frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(frame, expected) {
+			t.Fatal("incorrect frame")
+		}
+	}
+
+	if _, _, err := r.ReadFrame(); err != io.EOF {
+		t.Fatal("expected EOF at the end of the stream")
+	}
+}
+
+func TestFrameReader_TooLarge(t *testing.T) {
+	frame, _ := Encode(Notify{Predecessor: "localhost:5432"}, nil, 0)
+
+	r := NewFrameReader(bytes.NewReader(frame), uint32(len(frame)-FrameHeaderSize-1))
+	if _, _, err := r.ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatal("expected frame to be rejected")
+	}
+
+	// The size is checked before reading the body
+	header := FrameHeader{Version: FrameVersion, Length: 1 << 31}
+	r = NewFrameReader(bytes.NewReader(header.Encode()), DefaultMaxFrameSize)
+	if _, _, err := r.ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatal("expected frame to be rejected")
+	}
+}
+
+func TestFrameReader_Truncated(t *testing.T) {
+	frame, _ := Encode(Notify{Predecessor: "localhost:5432"}, nil, 0)
+
+	for _, n := range []int{1, FrameHeaderSize, len(frame) - 1} {
+		r := NewFrameReader(bytes.NewReader(frame[:n]), DefaultMaxFrameSize)
+		if _, _, err := r.ReadFrame(); err != ErrTruncatedFrame {
+			t.Fatal("expected truncated frame error, got", err)
+		}
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	frame, _ := Encode(Notify{Predecessor: "localhost:5432"}, nil, 0)
+
+	buf := &bytes.Buffer{}
+	w := NewFrameWriter(buf, DefaultMaxFrameSize)
+
+	if err := w.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), frame) {
+		t.Fatal("incorrect frame written")
+	}
+
+	if err := w.WriteFrame(frame[:len(frame)-1]); err != ErrMalformedFrame {
+		t.Fatal("expected malformed frame to be rejected")
+	}
+
+	w = NewFrameWriter(buf, 1)
+	if err := w.WriteFrame(frame); err != ErrFrameTooLarge {
+		t.Fatal("expected frame to be rejected")
+	}
+}
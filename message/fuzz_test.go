@@ -0,0 +1,193 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"github.com/hasyimibhar/p2p-chat/ratchet"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// fuzzMessage fuzzes the decoder of a message type. Decoding must never
+// panic, and any message that decodes successfully must survive being
+// encoded and decoded again.
+func fuzzMessage(f *testing.F, msg Message, seeds ...Message) {
+	for _, seed := range seeds {
+		encoded, err := seed.Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(encoded)
+	}
+
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		decoded, err := msg.Decode(buf)
+		if err != nil {
+			return
+		}
+
+		encoded, err := decoded.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := msg.Decode(encoded); err != nil {
+			t.Fatal("failed to decode re-encoded message:", err)
+		}
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	suite, err := chacha20poly1305.NewX(make([]byte, chacha20poly1305.KeySize))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, msg := range []Message{Ping{}, Notify{Predecessor: "localhost:8001"}, ChatLog{}} {
+		plaintext, _ := Encode(msg, nil, 0)
+		encrypted, _ := Encode(msg, suite, 1)
+
+		f.Add(plaintext)
+		f.Add(encrypted)
+	}
+
+	f.Add([]byte{})
+	f.Add(FrameHeader{Version: FrameVersion}.Encode())
+	f.Add(FrameHeader{Version: FrameVersion, Flags: FlagEncrypted}.Encode())
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		Decode(buf, nil, 0)
+		Decode(buf, suite, 1)
+	})
+}
+
+func FuzzHandshakeChallenge(f *testing.F) {
+	challenge, _ := NewHandshakeChallenge(CapSignedChat | CapRatchet)
+	fuzzMessage(f, HandshakeChallenge{}, challenge)
+}
+
+func FuzzHandshake(f *testing.F) {
+	a, A, _ := ed25519.GenerateKey()
+	handshake, _ := NewHandshake(a, A, make([]byte, 32), make([]byte, 32),
+		make([]byte, ChallengeSize), "localhost:8001")
+
+	fuzzMessage(f, Handshake{}, handshake)
+}
+
+func FuzzChat(f *testing.F) {
+	a, A, _ := ed25519.GenerateKey()
+	chat, _ := NewChat(a, A, "lorem ipsum dolor sit amet")
+
+	fuzzMessage(f, Chat{}, chat)
+}
+
+func FuzzChatLog(f *testing.F) {
+	a, A, _ := ed25519.GenerateKey()
+	chat1, _ := NewChat(a, A, "lorem ipsum")
+	chat2, _ := NewChat(a, A, "dolor sit amet")
+
+	fuzzMessage(f, ChatLog{}, ChatLog{}, ChatLog{Entries: []Chat{chat1, chat2}})
+}
+
+func FuzzStartPrivateChatRequest(f *testing.F) {
+	fuzzMessage(f, StartPrivateChatRequest{}, StartPrivateChatRequest{
+		Sender:     "localhost:8001",
+		SenderKey:  make([]byte, 32),
+		PublicKey:  make([]byte, 32),
+		RatchetKey: make([]byte, 32),
+	})
+}
+
+func FuzzStartPrivateChatResponse(f *testing.F) {
+	fuzzMessage(f, StartPrivateChatResponse{}, StartPrivateChatResponse{RatchetKey: make([]byte, 32)})
+}
+
+func FuzzPrivateChat(f *testing.F) {
+	fuzzMessage(f, PrivateChat{}, PrivateChat{
+		Sender:     make([]byte, 32),
+		PublicKey:  make([]byte, 32),
+		Header:     ratchet.Header{PublicKey: make([]byte, 32), MessageNumber: 1},
+		Ciphertext: []byte("ciphertext"),
+	})
+}
+
+func FuzzNotify(f *testing.F) {
+	fuzzMessage(f, Notify{}, Notify{Predecessor: "localhost:8001"})
+}
+
+func FuzzStabilizeResponse(f *testing.F) {
+	fuzzMessage(f, StabilizeResponse{}, StabilizeResponse{}, StabilizeResponse{
+		Predecessor: "localhost:8001",
+		PublicKey:   make([]byte, 32),
+	})
+}
+
+func FuzzFindSuccessorRequest(f *testing.F) {
+	fuzzMessage(f, FindSuccessorRequest{}, FindSuccessorRequest{ID: make([]byte, 32), AvoidFingers: true})
+}
+
+func FuzzFindSuccessorResponse(f *testing.F) {
+	fuzzMessage(f, FindSuccessorResponse{}, FindSuccessorResponse{
+		Found:     true,
+		PublicKey: make([]byte, 32),
+		Addr:      "localhost:8001",
+	})
+}
+
+func FuzzSuccessorRequest(f *testing.F) {
+	fuzzMessage(f, SuccessorRequest{}, SuccessorRequest{Count: 2})
+}
+
+func FuzzSuccessorResponse(f *testing.F) {
+	fuzzMessage(f, SuccessorResponse{}, SuccessorResponse{
+		Successors: []SuccessorEntry{
+			{PublicKey: make([]byte, 32), Addr: "localhost:8001"},
+		},
+	})
+}
+
+func FuzzStoreRequest(f *testing.F) {
+	fuzzMessage(f, StoreRequest{}, StoreRequest{
+		Key:   make([]byte, 32),
+		Value: []byte("value"),
+	})
+}
+
+func FuzzReplicate(f *testing.F) {
+	fuzzMessage(f, Replicate{}, Replicate{
+		Count: 2,
+		Key:   make([]byte, 32),
+		Value: []byte("value"),
+	})
+}
+
+func FuzzFetchRequest(f *testing.F) {
+	fuzzMessage(f, FetchRequest{}, FetchRequest{Key: make([]byte, 32)})
+}
+
+func FuzzFetchResponse(f *testing.F) {
+	fuzzMessage(f, FetchResponse{}, FetchResponse{Found: true, Value: []byte("value")})
+}
+
+func FuzzLeave(f *testing.F) {
+	fuzzMessage(f, Leave{}, Leave{
+		Predecessor:    "localhost:8001",
+		PredecessorKey: make([]byte, 32),
+		Successor:      "localhost:8002",
+		SuccessorKey:   make([]byte, 32),
+		Successors: []SuccessorEntry{
+			{PublicKey: make([]byte, 32), Addr: "localhost:8003"},
+		},
+	})
+}
+
+func FuzzMerge(f *testing.F) {
+	fuzzMessage(f, Merge{}, Merge{
+		Initiator:  make([]byte, 32),
+		ContactKey: make([]byte, 32),
+		Contact:    "localhost:8001",
+	})
+}
@@ -1,43 +1,188 @@
 package message
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
 	"github.com/hasyimibhar/p2p-chat/ed25519"
 )
 
+const (
+	ChallengeSize = 32
+
+	// ProtocolVersion is the version of the protocol spoken by this node.
+	// Version 2 numbers requests, so that responses are matched to them,
+	// and adds a nonce to chat messages.
+	ProtocolVersion = 2
+
+	// MinProtocolVersion is the oldest protocol version this node can
+	// still talk to.
+	MinProtocolVersion = 2
+)
+
+// Capabilities is a set of optional protocol features.
+type Capabilities uint32
+
+const (
+	// CapSignedChat means that public chat messages are signed
+	// by their author.
+	CapSignedChat Capabilities = 1 << iota
+
+	// CapRatchet means that private chat messages are encrypted
+	// with Double Ratchet sessions.
+	CapRatchet
+)
+
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapSignedChat, "signed-chat"},
+	{CapRatchet, "ratchet"},
+}
+
+// Has returns true if all capabilities in other are in c.
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+func (c Capabilities) String() string {
+	names := []string{}
+	for _, n := range capabilityNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+			c &^= n.cap
+		}
+	}
+
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(c)))
+	}
+
+	return strings.Join(names, ",")
+}
+
+// HandshakeChallenge is the first message exchanged by both peers when
+// a connection is established. It advertises the protocol version and
+// capabilities of the node, so that incompatible peers can be refused
+// early. The nonce must be signed by the other peer in its Handshake,
+// which proves that the handshake is not replayed.
+type HandshakeChallenge struct {
+	Version      uint16
+	Capabilities Capabilities
+	Nonce        []byte
+}
+
+func NewHandshakeChallenge(capabilities Capabilities) (HandshakeChallenge, error) {
+	nonce := make([]byte, ChallengeSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return HandshakeChallenge{}, err
+	}
+
+	return HandshakeChallenge{
+		Version:      ProtocolVersion,
+		Capabilities: capabilities,
+		Nonce:        nonce,
+	}, nil
+}
+
+func (m HandshakeChallenge) Encode() ([]byte, error) {
+	encoded := make([]byte, 6)
+	binary.BigEndian.PutUint16(encoded, m.Version)
+	binary.BigEndian.PutUint32(encoded[2:], uint32(m.Capabilities))
+
+	return append(encoded, m.Nonce...), nil
+}
+
+func (m HandshakeChallenge) Decode(buf []byte) (Message, error) {
+	if len(buf) != 6+ChallengeSize {
+		return nil, ErrInvalidMessageLength
+	}
+
+	return HandshakeChallenge{
+		Version:      binary.BigEndian.Uint16(buf[:2]),
+		Capabilities: Capabilities(binary.BigEndian.Uint32(buf[2:6])),
+		Nonce:        buf[6:],
+	}, nil
+}
+
+// Negotiate checks that the peer which sent the challenge is compatible
+// with this node, and returns the capabilities supported by both.
+func (m HandshakeChallenge) Negotiate(supported Capabilities, required Capabilities) (Capabilities, error) {
+	if m.Version < MinProtocolVersion {
+		return 0, fmt.Errorf("peer speaks protocol version %d, but version %d or later is required",
+			m.Version, MinProtocolVersion)
+	}
+
+	common := supported & m.Capabilities
+	if !common.Has(required) {
+		return 0, fmt.Errorf("peer lacks required capabilities (has %s, requires %s)",
+			m.Capabilities, required)
+	}
+
+	return common, nil
+}
+
+// Handshake is the response to HandshakeChallenge. It carries the node's
+// Ed25519 identity key, its X25519 key agreement key, a fresh X25519
+// ephemeral key for this connection and the challenge nonce received
+// from the other peer, all signed by the identity key.
 type Handshake struct {
-	PublicKey []byte
-	Addr      string
-	Signature []byte
+	PublicKey    []byte
+	AgreementKey []byte
+	EphemeralKey []byte
+	Challenge    []byte
+	Addr         string
+	Signature    []byte
 }
 
-func NewHandshake(privkey []byte, pubkey []byte, addr string) (Handshake, error) {
-	payload := append(pubkey, []byte(addr)...)
+func NewHandshake(privkey []byte, pubkey []byte, agreementKey []byte, ephemeralKey []byte, challenge []byte, addr string) (Handshake, error) {
+	m := Handshake{
+		PublicKey:    pubkey,
+		AgreementKey: agreementKey,
+		EphemeralKey: ephemeralKey,
+		Challenge:    challenge,
+		Addr:         addr,
+	}
 
-	sig, err := ed25519.Sign(privkey, pubkey, payload)
+	sig, err := ed25519.Sign(privkey, pubkey, m.payload())
 	if err != nil {
 		return Handshake{}, err
 	}
 
-	return Handshake{
-		PublicKey: pubkey,
-		Addr:      addr,
-		Signature: sig,
-	}, nil
+	m.Signature = sig
+	return m, nil
 }
 
 func (m Handshake) Verify() error {
-	payload := append(m.PublicKey, []byte(m.Addr)...)
-	return ed25519.Verify(m.PublicKey, payload, m.Signature)
+	return ed25519.Verify(m.PublicKey, m.payload(), m.Signature)
+}
+
+func (m Handshake) payload() []byte {
+	payload := append([]byte{}, m.PublicKey...)
+	payload = append(payload, m.AgreementKey...)
+	payload = append(payload, m.EphemeralKey...)
+	payload = append(payload, m.Challenge...)
+	return append(payload, []byte(m.Addr)...)
 }
 
 func (m Handshake) Encode() ([]byte, error) {
-	return append(m.PublicKey, append([]byte(m.Addr), m.Signature...)...), nil
+	return append(m.payload(), m.Signature...), nil
 }
 
 func (m Handshake) Decode(buf []byte) (Message, error) {
+	if err := checkLength(buf, 128+64); err != nil {
+		return nil, err
+	}
+
 	return Handshake{
-		PublicKey: buf[:32],
-		Addr:      string(buf[32 : len(buf)-64]),
-		Signature: buf[len(buf)-64:],
+		PublicKey:    buf[:32],
+		AgreementKey: buf[32:64],
+		EphemeralKey: buf[64:96],
+		Challenge:    buf[96:128],
+		Addr:         string(buf[128 : len(buf)-64]),
+		Signature:    buf[len(buf)-64:],
 	}, nil
 }
@@ -5,20 +5,29 @@ import (
 	"testing"
 
 	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"github.com/hasyimibhar/p2p-chat/x25519"
 )
 
 func TestHandshake_EncodeDecodeVerify(t *testing.T) {
 	priv, pub, _ := ed25519.GenerateKey()
-	msg, _ := NewHandshake(priv, pub, "localhost:1234")
+	_, agreementKey, _ := x25519.GenerateKey()
+	_, ephemeralKey, _ := x25519.GenerateKey()
+	challenge, _ := NewHandshakeChallenge(CapSignedChat)
+	msg, _ := NewHandshake(priv, pub, agreementKey, ephemeralKey, challenge.Nonce, "localhost:1234")
 
 	encoded, err := msg.Encode()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	sig, _ := ed25519.Sign(priv, pub, append(pub, []byte("localhost:1234")...))
+	payload := append([]byte{}, pub...)
+	payload = append(payload, agreementKey...)
+	payload = append(payload, ephemeralKey...)
+	payload = append(payload, challenge.Nonce...)
+	payload = append(payload, []byte("localhost:1234")...)
+	sig, _ := ed25519.Sign(priv, pub, payload)
 
-	if !bytes.Equal(encoded, append(pub, append([]byte("localhost:1234"), sig...)...)) {
+	if !bytes.Equal(encoded, append(payload, sig...)) {
 		t.Fatal("encoded message is incorrect")
 	}
 
@@ -39,6 +48,15 @@ func TestHandshake_EncodeDecodeVerify(t *testing.T) {
 	if !bytes.Equal(handshake.PublicKey, pub) {
 		t.Fatal("decoded message is incorrect")
 	}
+	if !bytes.Equal(handshake.AgreementKey, agreementKey) {
+		t.Fatal("decoded message is incorrect")
+	}
+	if !bytes.Equal(handshake.EphemeralKey, ephemeralKey) {
+		t.Fatal("decoded message is incorrect")
+	}
+	if !bytes.Equal(handshake.Challenge, challenge.Nonce) {
+		t.Fatal("decoded message is incorrect")
+	}
 	if handshake.Addr != "localhost:1234" {
 		t.Fatal("decoded message is incorrect")
 	}
@@ -46,3 +64,103 @@ func TestHandshake_EncodeDecodeVerify(t *testing.T) {
 		t.Fatal("decoded message is incorrect")
 	}
 }
+
+func TestHandshake_VerifyTampered(t *testing.T) {
+	priv, pub, _ := ed25519.GenerateKey()
+	_, agreementKey, _ := x25519.GenerateKey()
+	_, ephemeralKey, _ := x25519.GenerateKey()
+	challenge, _ := NewHandshakeChallenge(CapSignedChat)
+	msg, _ := NewHandshake(priv, pub, agreementKey, ephemeralKey, challenge.Nonce, "localhost:1234")
+
+	// Swapping any of the keys must invalidate the signature
+	tampered := msg
+	_, tampered.AgreementKey, _ = x25519.GenerateKey()
+
+	if err := tampered.Verify(); err == nil {
+		t.Fatal("expected invalid signature")
+	}
+
+	tampered = msg
+	_, tampered.EphemeralKey, _ = x25519.GenerateKey()
+
+	if err := tampered.Verify(); err == nil {
+		t.Fatal("expected invalid signature")
+	}
+
+	// So must replaying it against a different challenge
+	tampered = msg
+	other, _ := NewHandshakeChallenge(CapSignedChat)
+	tampered.Challenge = other.Nonce
+
+	if err := tampered.Verify(); err == nil {
+		t.Fatal("expected invalid signature")
+	}
+}
+
+func TestHandshakeChallenge_EncodeDecode(t *testing.T) {
+	msg, err := NewHandshakeChallenge(CapSignedChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msg.Nonce) != ChallengeSize {
+		t.Fatal("incorrect nonce size")
+	}
+
+	encoded, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := HandshakeChallenge{}.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, ok := decoded.(HandshakeChallenge)
+	if !ok {
+		t.Fatal("wrong message type")
+	}
+
+	if !bytes.Equal(challenge.Nonce, msg.Nonce) {
+		t.Fatal("decoded message is incorrect")
+	}
+	if challenge.Version != ProtocolVersion {
+		t.Fatal("decoded message is incorrect")
+	}
+	if challenge.Capabilities != CapSignedChat {
+		t.Fatal("decoded message is incorrect")
+	}
+}
+
+func TestHandshakeChallenge_Negotiate(t *testing.T) {
+	tests := []struct {
+		Challenge HandshakeChallenge
+		Supported Capabilities
+		Required  Capabilities
+		Common    Capabilities
+		Error     bool
+	}{
+		{HandshakeChallenge{Version: ProtocolVersion, Capabilities: CapSignedChat | CapRatchet},
+			CapSignedChat | CapRatchet, CapSignedChat, CapSignedChat | CapRatchet, false},
+		{HandshakeChallenge{Version: ProtocolVersion, Capabilities: CapSignedChat},
+			CapSignedChat | CapRatchet, CapSignedChat, CapSignedChat, false},
+		{HandshakeChallenge{Version: ProtocolVersion, Capabilities: CapSignedChat | 1<<31},
+			CapSignedChat | CapRatchet, CapSignedChat, CapSignedChat, false},
+		{HandshakeChallenge{Version: ProtocolVersion, Capabilities: CapRatchet},
+			CapSignedChat | CapRatchet, CapSignedChat, 0, true},
+		{HandshakeChallenge{Version: MinProtocolVersion - 1, Capabilities: CapSignedChat | CapRatchet},
+			CapSignedChat | CapRatchet, CapSignedChat, 0, true},
+	}
+
+	for _, tt := range tests {
+		common, err := tt.Challenge.Negotiate(tt.Supported, tt.Required)
+		if (err != nil) != tt.Error {
+			t.Fatal("unexpected negotiation result:", err)
+		}
+
+		if common != tt.Common {
+			t.Fatal("incorrect common capabilities")
+		}
+	}
+}
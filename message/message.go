@@ -2,13 +2,37 @@ package message
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"reflect"
 )
 
 const (
 	NonceSize = 24
+
+	// RequestHeaderSize is the size of the request header which
+	// follows the opcode of requests and responses:
+	//
+	// - 1 byte: request flags
+	// - 4 bytes: request ID
+	//
+	RequestHeaderSize = 5
+)
+
+// RequestFlags describes how a message relates to a request.
+type RequestFlags byte
+
+const (
+	// FlagResponse is set if the message is the response
+	// to a request sent by the other side.
+	FlagResponse RequestFlags = 1 << iota
+)
+
+var (
+	ErrUnexpectedSequence   = fmt.Errorf("unexpected sequence number")
+	ErrInvalidOpcode        = fmt.Errorf("invalid opcode")
+	ErrMessageTooShort      = fmt.Errorf("message too short")
+	ErrInvalidMessageLength = fmt.Errorf("invalid message length")
 )
 
 // Message is the interface that any message must implement.
@@ -17,6 +41,22 @@ type Message interface {
 	Decode([]byte) (Message, error)
 }
 
+// Envelope is a message along with the request it belongs to.
+type Envelope struct {
+	// RequestID identifies the request the message is part of. It's
+	// zero if the message is neither a request nor a response. Each
+	// side numbers the requests it sends, so a request is only told
+	// apart from a response with the same ID by the response flag.
+	RequestID uint32
+	Flags     RequestFlags
+	Message   Message
+}
+
+// IsResponse returns true if the message is the response to a request.
+func (e Envelope) IsResponse() bool {
+	return e.Flags&FlagResponse != 0
+}
+
 // MessageFromOpcode returns the message type associated to the opcode.
 func MessageFromOpcode(opcode Opcode) (Message, error) {
 	mtx.Lock()
@@ -24,12 +64,12 @@ func MessageFromOpcode(opcode Opcode) (Message, error) {
 
 	tp, ok := opcodes[Opcode(opcode)]
 	if !ok {
-		return nil, fmt.Errorf("invalid opcode")
+		return nil, ErrInvalidOpcode
 	}
 
 	message, ok := reflect.New(reflect.TypeOf(tp)).Elem().Interface().(Message)
 	if !ok {
-		return nil, fmt.Errorf("invalid opcode")
+		return nil, ErrInvalidOpcode
 	}
 
 	return message, nil
@@ -53,73 +93,183 @@ func OpcodeFromMessage(msg Message) (Opcode, error) {
 	return opcode, nil
 }
 
-// Encode encodes the message for transport, and at the same time
-// encrypts and signs the message.
+// Encode encodes a message which is not part of any request. See
+// EncodeEnvelope.
+func Encode(msg Message, suite cipher.AEAD, seq uint64) ([]byte, error) {
+	return EncodeEnvelope(Envelope{Message: msg}, suite, seq)
+}
+
+// Decode decodes a frame into a message, regardless of the request it
+// belongs to. See DecodeEnvelope.
+func Decode(buf []byte, suite cipher.AEAD, seq uint64) (Opcode, Message, error) {
+	opcode, envelope, err := decode(buf, suite, seq)
+	return opcode, envelope.Message, err
+}
+
+// EncodeEnvelope encodes the message into a frame for transport, and at
+// the same time encrypts the message if suite is not nil.
 //
 // The format is as follows:
 //
+// - 6 bytes: frame header (see FrameHeader)
+// - 8 bytes: sequence number (encrypted frames only)
 // - 1 byte: message opcode
-// - 24 bytes: message nonce (for AEAD)
+// - 5 bytes: request header (see RequestHeaderSize and FlagRequest)
 // - remaining bytes: the message body
 //
-func Encode(msg Message, suite cipher.AEAD, privkey []byte, pubkey []byte) ([]byte, error) {
-	opcode, err := OpcodeFromMessage(msg)
+// Frames without a request header, e.g. those of the handshake, are
+// laid out the same way for every protocol version, so that peers
+// speaking another version can still negotiate with the node.
+//
+// For encrypted frames, the opcode and message body are encrypted, and the
+// frame header is authenticated as associated data. The nonce is derived
+// from seq, the sequence number of the frame in the sending direction,
+// which must start at 1 and increase by one for each encrypted frame.
+func EncodeEnvelope(envelope Envelope, suite cipher.AEAD, seq uint64) ([]byte, error) {
+	if envelope.IsResponse() && envelope.RequestID == 0 {
+		return nil, fmt.Errorf("response without request ID")
+	}
+
+	opcode, err := OpcodeFromMessage(envelope.Message)
 	if err != nil {
 		return nil, err
 	}
 
-	msgbuf, err := msg.Encode()
+	body, err := envelope.Message.Encode()
 	if err != nil {
 		return nil, err
 	}
 
-	msgbuf = append([]byte{byte(opcode)}, msgbuf...)
+	header := FrameHeader{
+		Version: FrameVersion,
+	}
 
-	// Generate nonce
-	nonce := make([]byte, NonceSize)
-	if suite != nil {
-		if _, err := rand.Read(nonce); err != nil {
-			return nil, err
-		}
+	msgbuf := []byte{byte(opcode)}
+	if envelope.RequestID != 0 || envelope.Flags != 0 {
+		header.Flags |= FlagRequest
+
+		requestHeader := make([]byte, RequestHeaderSize)
+		requestHeader[0] = byte(envelope.Flags)
+		binary.BigEndian.PutUint32(requestHeader[1:], envelope.RequestID)
+		msgbuf = append(msgbuf, requestHeader...)
+	}
+	msgbuf = append(msgbuf, body...)
+	header.Length = uint32(len(msgbuf))
 
-		msgbuf = suite.Seal(nil, nonce, msgbuf, nil)
+	if suite == nil {
+		return append(header.Encode(), msgbuf...), nil
 	}
 
-	encoded := make([]byte, len(msgbuf)+NonceSize)
-	copy(encoded, nonce)
-	copy(encoded[NonceSize:], msgbuf)
+	if seq == 0 {
+		return nil, fmt.Errorf("invalid sequence number")
+	}
+
+	header.Flags |= FlagEncrypted
+	header.Length = uint32(SequenceSize + len(msgbuf) + suite.Overhead())
+
+	ad := header.Encode()
+
+	encoded := make([]byte, FrameHeaderSize+SequenceSize)
+	copy(encoded, ad)
+	binary.BigEndian.PutUint64(encoded[FrameHeaderSize:], seq)
 
-	return encoded, nil
+	return suite.Seal(encoded, nonce(seq), msgbuf, ad), nil
 }
 
-// Decode decodes the byte slice into a message.
-func Decode(buf []byte, suite cipher.AEAD, pubkey []byte) (Opcode, Message, error) {
-	nonce := buf[:NonceSize]
-	encrypted := buf[NonceSize:]
+// DecodeEnvelope decodes a frame into a message along with the request
+// it belongs to. If suite is not nil, the frame must be encrypted, and
+// its sequence number must be seq, so that duplicated, reordered or
+// replayed frames are rejected. Otherwise, the frame must not be
+// encrypted.
+func DecodeEnvelope(buf []byte, suite cipher.AEAD, seq uint64) (Envelope, error) {
+	_, envelope, err := decode(buf, suite, seq)
+	return envelope, err
+}
+
+func decode(buf []byte, suite cipher.AEAD, seq uint64) (Opcode, Envelope, error) {
+	header, err := DecodeFrameHeader(buf)
+	if err != nil {
+		return OpcodeNull, Envelope{}, err
+	}
+
+	body := buf[FrameHeaderSize:]
+	if uint32(len(body)) != header.Length {
+		return OpcodeNull, Envelope{}, ErrMalformedFrame
+	}
+
+	if header.Encrypted() != (suite != nil) {
+		return OpcodeNull, Envelope{}, ErrUnexpectedEncryption
+	}
 
 	var msgbuf []byte
-	var err error
 
 	// Decrypt message body
 	if suite != nil {
-		msgbuf, err = suite.Open(nil, nonce, encrypted, nil)
+		if len(body) < SequenceSize {
+			return OpcodeNull, Envelope{}, ErrMalformedFrame
+		}
+
+		if binary.BigEndian.Uint64(body[:SequenceSize]) != seq {
+			return OpcodeNull, Envelope{}, ErrUnexpectedSequence
+		}
+
+		msgbuf, err = suite.Open(nil, nonce(seq), body[SequenceSize:], buf[:FrameHeaderSize])
 		if err != nil {
-			return OpcodeNull, nil, err
+			return OpcodeNull, Envelope{}, err
 		}
 	} else {
-		msgbuf = encrypted
+		msgbuf = body
+	}
+
+	if len(msgbuf) == 0 {
+		return OpcodeNull, Envelope{}, ErrMalformedFrame
 	}
 
 	opcode := Opcode(msgbuf[0])
 	msg, err := MessageFromOpcode(opcode)
 	if err != nil {
-		return OpcodeNull, nil, err
+		return OpcodeNull, Envelope{}, err
 	}
 
-	msg, err = msg.Decode(msgbuf[1:])
+	envelope := Envelope{}
+	msgbuf = msgbuf[1:]
+
+	if header.Request() {
+		if err := checkLength(msgbuf, RequestHeaderSize); err != nil {
+			return OpcodeNull, Envelope{}, err
+		}
+
+		envelope.Flags = RequestFlags(msgbuf[0])
+		envelope.RequestID = binary.BigEndian.Uint32(msgbuf[1:])
+		msgbuf = msgbuf[RequestHeaderSize:]
+
+		if envelope.Flags&^FlagResponse != 0 || envelope.RequestID == 0 {
+			return OpcodeNull, Envelope{}, ErrMalformedFrame
+		}
+	}
+
+	envelope.Message, err = msg.Decode(msgbuf)
 	if err != nil {
-		return OpcodeNull, nil, err
+		return OpcodeNull, Envelope{}, err
 	}
 
-	return opcode, msg, nil
+	return opcode, envelope, nil
+}
+
+// checkLength returns an error if buf is shorter than size bytes.
+// Every decoder must check the length of the buffer before slicing
+// it, since it comes straight from the peer.
+func checkLength(buf []byte, size int) error {
+	if len(buf) < size {
+		return ErrMessageTooShort
+	}
+
+	return nil
+}
+
+// nonce returns the AEAD nonce of the frame with the sequence number.
+func nonce(seq uint64) []byte {
+	nonce := make([]byte, NonceSize)
+	binary.BigEndian.PutUint64(nonce[NonceSize-SequenceSize:], seq)
+	return nonce
 }
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"github.com/hasyimibhar/p2p-chat/x25519"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 )
@@ -93,25 +94,23 @@ func TestMessageFromOpcode_Error(t *testing.T) {
 
 func TestEncodeDecode(t *testing.T) {
 	a, A, _ := ed25519.GenerateKey()
-	b, B, _ := ed25519.GenerateKey()
+	ka, KA, _ := x25519.GenerateKey()
+	kb, KB, _ := x25519.GenerateKey()
 
-	secretA, _ := ed25519.ComputeSharedSecret(a, B)
-	secretB, _ := ed25519.ComputeSharedSecret(b, A)
+	secretA, _ := x25519.ComputeSharedSecret(ka, KB)
+	secretB, _ := x25519.ComputeSharedSecret(kb, KA)
 
 	suiteA := cipherSuite(t, secretA)
 	suiteB := cipherSuite(t, secretB)
 
-	chatA := Chat{
-		PublicKey: A,
-		Text:      "lorem ipsum dolor sit amet",
-	}
+	chatA, _ := NewChat(a, A, "lorem ipsum dolor sit amet")
 
-	encoded, err := Encode(chatA, suiteA, a, A)
+	encoded, err := Encode(chatA, suiteA, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	opcode, msg, err := Decode(encoded, suiteB, B)
+	opcode, msg, err := Decode(encoded, suiteB, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,11 +133,11 @@ func TestEncodeDecode(t *testing.T) {
 }
 
 func TestEncodeDecode_Notify(t *testing.T) {
-	a, A, _ := ed25519.GenerateKey()
-	b, B, _ := ed25519.GenerateKey()
+	ka, KA, _ := x25519.GenerateKey()
+	kb, KB, _ := x25519.GenerateKey()
 
-	secretA, _ := ed25519.ComputeSharedSecret(a, B)
-	secretB, _ := ed25519.ComputeSharedSecret(b, A)
+	secretA, _ := x25519.ComputeSharedSecret(ka, KB)
+	secretB, _ := x25519.ComputeSharedSecret(kb, KA)
 
 	suiteA := cipherSuite(t, secretA)
 	suiteB := cipherSuite(t, secretB)
@@ -147,12 +146,12 @@ func TestEncodeDecode_Notify(t *testing.T) {
 		Predecessor: "localhost:5432",
 	}
 
-	encoded, err := Encode(notifyA, suiteA, a, A)
+	encoded, err := Encode(notifyA, suiteA, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	opcode, msg, err := Decode(encoded, suiteB, B)
+	opcode, msg, err := Decode(encoded, suiteB, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -171,6 +170,187 @@ func TestEncodeDecode_Notify(t *testing.T) {
 	}
 }
 
+func TestEncodeDecode_Envelope(t *testing.T) {
+	suite := cipherSuite(t, make([]byte, 32))
+
+	request := Envelope{RequestID: 42, Message: Ping{}}
+	response := Envelope{RequestID: 42, Flags: FlagResponse, Message: Pong{}}
+
+	for i, envelope := range []Envelope{request, response} {
+		encoded, err := EncodeEnvelope(envelope, suite, uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := DecodeEnvelope(encoded, suite, uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(decoded, envelope) {
+			t.Fatal("incorrect decoded envelope")
+		}
+	}
+
+	if _, err := EncodeEnvelope(Envelope{Flags: FlagResponse, Message: Pong{}}, nil, 0); err == nil {
+		t.Fatal("expected error for response without request ID")
+	}
+
+	// Unknown request flags, and responses without a request ID,
+	// are rejected
+	encoded, _ := EncodeEnvelope(response, nil, 0)
+
+	unknownFlag := append([]byte{}, encoded...)
+	unknownFlag[FrameHeaderSize+1] |= 0x80
+	if _, err := DecodeEnvelope(unknownFlag, nil, 0); err != ErrMalformedFrame {
+		t.Fatal("expected unknown request flag to be rejected")
+	}
+
+	noID := append([]byte{}, encoded...)
+	copy(noID[FrameHeaderSize+2:], []byte{0, 0, 0, 0})
+	if _, err := DecodeEnvelope(noID, nil, 0); err != ErrMalformedFrame {
+		t.Fatal("expected response without request ID to be rejected")
+	}
+}
+
+func TestEncode_WithoutRequestHeader(t *testing.T) {
+	challenge, _ := NewHandshakeChallenge(CapSignedChat)
+	body, _ := challenge.Encode()
+
+	// Messages which are not part of a request are laid out the
+	// same way for every protocol version
+	encoded, err := Encode(challenge, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _ := DecodeFrameHeader(encoded)
+	if header.Request() {
+		t.Fatal("unexpected request header")
+	}
+
+	expected := append([]byte{byte(OpcodeHandshakeChallenge)}, body...)
+	if !bytes.Equal(encoded[FrameHeaderSize:], expected) {
+		t.Fatal("encoded message is incorrect")
+	}
+
+	request, _ := EncodeEnvelope(Envelope{RequestID: 42, Message: challenge}, nil, 0)
+	if header, _ := DecodeFrameHeader(request); !header.Request() {
+		t.Fatal("missing request header")
+	}
+}
+
+func TestEncodeDecode_Sequence(t *testing.T) {
+	ka, KA, _ := x25519.GenerateKey()
+	kb, KB, _ := x25519.GenerateKey()
+
+	secretA, _ := x25519.ComputeSharedSecret(ka, KB)
+	secretB, _ := x25519.ComputeSharedSecret(kb, KA)
+
+	suiteA := cipherSuite(t, secretA)
+	suiteB := cipherSuite(t, secretB)
+
+	if _, err := Encode(Ping{}, suiteA, 0); err == nil {
+		t.Fatal("expected error for zero sequence number")
+	}
+
+	first, _ := Encode(Ping{}, suiteA, 1)
+	second, _ := Encode(Ping{}, suiteA, 2)
+
+	if _, _, err := Decode(first, suiteB, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the first message
+	if _, _, err := Decode(first, suiteB, 2); err != ErrUnexpectedSequence {
+		t.Fatal("expected replayed message to be rejected")
+	}
+
+	// Skipping a message
+	if _, _, err := Decode(second, suiteB, 3); err != ErrUnexpectedSequence {
+		t.Fatal("expected out-of-order message to be rejected")
+	}
+
+	// Tampering with the sequence number
+	tampered := append([]byte{}, first...)
+	tampered[FrameHeaderSize+SequenceSize-1] = 2
+	if _, _, err := Decode(tampered, suiteB, 2); err == nil {
+		t.Fatal("expected tampered message to be rejected")
+	}
+
+	if _, _, err := Decode(second, suiteB, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeDecode_Unencrypted(t *testing.T) {
+	ka, KA, _ := x25519.GenerateKey()
+	kb, KB, _ := x25519.GenerateKey()
+
+	secretA, _ := x25519.ComputeSharedSecret(ka, KB)
+	secretB, _ := x25519.ComputeSharedSecret(kb, KA)
+
+	suiteA := cipherSuite(t, secretA)
+	suiteB := cipherSuite(t, secretB)
+
+	plaintext, err := Encode(Notify{Predecessor: "localhost:5432"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := DecodeFrameHeader(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Encrypted() {
+		t.Fatal("frame should not be marked as encrypted")
+	}
+
+	if _, _, err := Decode(plaintext, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unencrypted frames are not accepted once the connection is encrypted
+	if _, _, err := Decode(plaintext, suiteB, 1); err != ErrUnexpectedEncryption {
+		t.Fatal("expected unencrypted frame to be rejected")
+	}
+
+	encrypted, _ := Encode(Notify{Predecessor: "localhost:5432"}, suiteA, 1)
+	if _, _, err := Decode(encrypted, nil, 0); err != ErrUnexpectedEncryption {
+		t.Fatal("expected encrypted frame to be rejected")
+	}
+}
+
+func TestEncodeDecode_TamperedHeader(t *testing.T) {
+	ka, KA, _ := x25519.GenerateKey()
+	kb, KB, _ := x25519.GenerateKey()
+
+	secretA, _ := x25519.ComputeSharedSecret(ka, KB)
+	secretB, _ := x25519.ComputeSharedSecret(kb, KA)
+
+	suiteA := cipherSuite(t, secretA)
+	suiteB := cipherSuite(t, secretB)
+
+	encoded, _ := Encode(Ping{}, suiteA, 1)
+
+	// Setting an unknown flag must invalidate the frame
+	tampered := append([]byte{}, encoded...)
+	tampered[1] |= 0x80
+	if _, _, err := Decode(tampered, suiteB, 1); err == nil {
+		t.Fatal("expected tampered frame to be rejected")
+	}
+
+	tampered = append([]byte{}, encoded...)
+	tampered[0] = FrameVersion + 1
+	if _, _, err := Decode(tampered, suiteB, 1); err != ErrUnsupportedVersion {
+		t.Fatal("expected unsupported version error")
+	}
+
+	if _, _, err := Decode(encoded, suiteB, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func cipherSuite(t *testing.T, ephemeralSecret []byte) cipher.AEAD {
 	hkdf := hkdf.New(sha256.New, ephemeralSecret, nil, nil)
 
@@ -186,3 +366,36 @@ func cipherSuite(t *testing.T, ephemeralSecret []byte) cipher.AEAD {
 
 	return suite
 }
+
+func TestDecode_Malformed(t *testing.T) {
+	a, A, _ := ed25519.GenerateKey()
+	chat, _ := NewChat(a, A, "lorem ipsum dolor sit amet")
+	encoded, _ := Encode(chat, nil, 0)
+
+	// Truncating the message body must not panic
+	for n := FrameHeaderSize + 1; n < FrameHeaderSize+97; n++ {
+		header := FrameHeader{Version: FrameVersion, Length: uint32(n - FrameHeaderSize)}
+		truncated := append(header.Encode(), encoded[FrameHeaderSize:n]...)
+
+		if _, _, err := Decode(truncated, nil, 0); err != ErrMessageTooShort {
+			t.Fatal("expected truncated message to be rejected, got", err)
+		}
+	}
+
+	// Frame without an opcode
+	empty := FrameHeader{Version: FrameVersion}.Encode()
+	if _, _, err := Decode(empty, nil, 0); err != ErrMalformedFrame {
+		t.Fatal("expected empty frame to be rejected")
+	}
+
+	if _, _, err := Decode(append(FrameHeader{Version: FrameVersion, Length: 1}.Encode(), 42), nil, 0); err != ErrInvalidOpcode {
+		t.Fatal("expected invalid opcode error")
+	}
+
+	// Encrypted frame too short to contain a sequence number
+	suite := cipherSuite(t, make([]byte, 32))
+	short := append(FrameHeader{Version: FrameVersion, Flags: FlagEncrypted, Length: 2}.Encode(), 1, 2)
+	if _, _, err := Decode(short, suite, 1); err != ErrMalformedFrame {
+		t.Fatal("expected short frame to be rejected")
+	}
+}
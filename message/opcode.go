@@ -22,6 +22,17 @@ const (
 	OpcodeSuccessorRequest
 	OpcodeSuccessorResponse
 	OpcodePing
+	OpcodeHandshakeChallenge
+	OpcodePong
+	OpcodeFindSuccessorRequest
+	OpcodeFindSuccessorResponse
+	OpcodeStoreRequest
+	OpcodeStoreResponse
+	OpcodeReplicate
+	OpcodeFetchRequest
+	OpcodeFetchResponse
+	OpcodeLeave
+	OpcodeMerge
 )
 
 var opcodes map[Opcode]Message
@@ -45,6 +56,17 @@ func init() {
 	registerMessage(OpcodeSuccessorRequest, (*SuccessorRequest)(nil))
 	registerMessage(OpcodeSuccessorResponse, (*SuccessorResponse)(nil))
 	registerMessage(OpcodePing, (*Ping)(nil))
+	registerMessage(OpcodeHandshakeChallenge, (*HandshakeChallenge)(nil))
+	registerMessage(OpcodePong, (*Pong)(nil))
+	registerMessage(OpcodeFindSuccessorRequest, (*FindSuccessorRequest)(nil))
+	registerMessage(OpcodeFindSuccessorResponse, (*FindSuccessorResponse)(nil))
+	registerMessage(OpcodeStoreRequest, (*StoreRequest)(nil))
+	registerMessage(OpcodeStoreResponse, (*StoreResponse)(nil))
+	registerMessage(OpcodeReplicate, (*Replicate)(nil))
+	registerMessage(OpcodeFetchRequest, (*FetchRequest)(nil))
+	registerMessage(OpcodeFetchResponse, (*FetchResponse)(nil))
+	registerMessage(OpcodeLeave, (*Leave)(nil))
+	registerMessage(OpcodeMerge, (*Merge)(nil))
 }
 
 func registerMessage(o Opcode, m interface{}) Opcode {
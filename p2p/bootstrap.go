@@ -0,0 +1,219 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// knownPeer is an entry of the known peers file.
+type knownPeer struct {
+	Addr      string `json:"addr"`
+	PublicKey []byte `json:"public_key"`
+}
+
+// Bootstrap joins the ring through the bootstrap peers, or else
+// through the peers the node has seen before. If none of them can be
+// reached, the node keeps trying in the background, and the error of
+// the first attempt is returned. A node with neither bootstrap nor
+// known peers starts a new ring.
+func (n *Node) Bootstrap() error {
+	if len(n.bootstrapCandidates()) == 0 {
+		return nil
+	}
+
+	if err := n.join(); err != nil {
+		n.startRejoin()
+		return err
+	}
+
+	return nil
+}
+
+// bootstrapCandidates returns the peers the node can join the ring
+// through: the bootstrap peers, followed by the known peers ordered
+// by their distance from the node.
+func (n *Node) bootstrapCandidates() []remoteNode {
+	candidates := []remoteNode{}
+	seen := map[string]bool{n.Addr(): true}
+
+	for _, address := range n.config.BootstrapPeers {
+		if !seen[address] {
+			seen[address] = true
+			candidates = append(candidates, remoteNode{addr: address})
+		}
+	}
+
+	for _, p := range n.closestKnownPeers() {
+		if !seen[p.addr] {
+			seen[p.addr] = true
+			candidates = append(candidates, p)
+		}
+	}
+
+	return candidates
+}
+
+// join looks up the successor of the node through each candidate in
+// turn, until one of them answers. A candidate which answers with the
+// node itself still considers the node part of its ring, e.g. right
+// after a partition, so it can't tell the node its successor yet.
+func (n *Node) join() error {
+	err := fmt.Errorf("no peer to join")
+
+	for _, c := range n.bootstrapCandidates() {
+		var address string
+		var key []byte
+
+		address, key, err = n.findSuccessor(c.addr, c.key, n.id)
+		if err != nil {
+			continue
+		}
+
+		if bytes.Equal(key, n.pubkey) {
+			err = fmt.Errorf("peer %s still considers the node its member", c.addr)
+			continue
+		}
+
+		if err = n.setSuccessor(address, key); err == nil {
+			log.Printf("[info] joined the ring through %s", c.addr)
+			return nil
+		}
+	}
+
+	return err
+}
+
+// startRejoin starts trying to rejoin the ring in the background,
+// unless the node is already doing so.
+func (n *Node) startRejoin() {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.rejoining {
+		return
+	}
+
+	n.rejoining = true
+	go n.handleRejoin()
+}
+
+// handleRejoin retries joining the ring with exponential backoff,
+// until the node has a successor again.
+func (n *Node) handleRejoin() {
+	defer func() {
+		n.mtx.Lock()
+		n.rejoining = false
+		n.mtx.Unlock()
+	}()
+
+	interval := n.config.RejoinInterval
+
+	for {
+		select {
+		case <-n.config.Clock.After(interval):
+		case <-n.closeCh:
+			return
+		}
+
+		// Another peer may have found the node in the meantime
+		if n.Successor() != nil {
+			return
+		}
+
+		err := n.join()
+		if err == nil {
+			return
+		}
+
+		interval *= 2
+		if interval > n.config.MaxRejoinInterval {
+			interval = n.config.MaxRejoinInterval
+		}
+
+		log.Printf("[warn] failed to rejoin the ring, retrying in %s: %s", interval, err)
+	}
+}
+
+// loadKnownPeers reads the known peers saved at path. A missing
+// file means that the node has not seen any peer yet.
+func loadKnownPeers(path string) (map[string][]byte, error) {
+	knownPeers := map[string][]byte{}
+
+	encoded, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return knownPeers, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	peers := []knownPeer{}
+	if err := json.Unmarshal(encoded, &peers); err != nil {
+		return nil, fmt.Errorf("invalid known peers file: %s", err)
+	}
+
+	for _, p := range peers {
+		if len(p.PublicKey) == 32 && len(knownPeers) < maxKnownPeers {
+			knownPeers[p.Addr] = p.PublicKey
+		}
+	}
+
+	return knownPeers, nil
+}
+
+// saveKnownPeers writes the known peers to the configured file.
+func (n *Node) saveKnownPeers() error {
+	if n.config.KnownPeersPath == "" {
+		return nil
+	}
+
+	// Saves are serialized, so that the file
+	// ends up with the latest known peers
+	n.saveMtx.Lock()
+	defer n.saveMtx.Unlock()
+
+	n.mtx.Lock()
+	peers := []knownPeer{}
+	for address, key := range n.knownPeers {
+		peers = append(peers, knownPeer{Addr: address, PublicKey: key})
+	}
+	n.mtx.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+
+	encoded, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, and sync it before renaming
+	// it, so that a crash or a power loss never leaves a truncated
+	// file behind.
+	path := n.config.KnownPeersPath
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".peers-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,180 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/clock"
+	"github.com/hasyimibhar/p2p-chat/message"
+	"github.com/hasyimibhar/p2p-chat/transport"
+)
+
+const (
+	DefaultStabilizeInterval        = 5 * time.Second
+	DefaultFixFingersInterval       = 5 * time.Second
+	DefaultCheckPredecessorInterval = 5 * time.Second
+	DefaultProbeInterval            = 30 * time.Second
+	DefaultPingTimeout              = 1 * time.Second
+	DefaultSuccessorListSize        = 2
+	DefaultDialTimeout              = 10 * time.Second
+	DefaultHandshakeTimeout         = 10 * time.Second
+	DefaultRequestTimeout           = 5 * time.Second
+	DefaultMaxConnections           = 64
+	DefaultMaxStoreSize             = 64 << 20
+	DefaultIdleConnTimeout          = 1 * time.Minute
+	DefaultRejoinInterval           = 5 * time.Second
+	DefaultMaxRejoinInterval        = 5 * time.Minute
+)
+
+// Config configures a node. Zero values are replaced by defaults.
+type Config struct {
+	// Addr is the address advertised to the node's peers, which
+	// they connect to. It's signed into the handshake.
+	Addr string
+
+	// ListenAddr is the address the node listens on, e.g. to bind
+	// to all interfaces or to a port which is forwarded to Addr.
+	// Defaults to Addr.
+	ListenAddr string
+
+	// Transport is used to listen for and connect to peers.
+	// Defaults to TCP.
+	Transport transport.Transport
+
+	// Clock drives all of the node's timers. Defaults to the
+	// wall clock.
+	Clock clock.Clock
+
+	// StabilizeInterval is the period of the stabilization routine.
+	StabilizeInterval time.Duration
+
+	// FixFingersInterval is the period of the routine which
+	// refreshes the finger table, one finger at a time.
+	FixFingersInterval time.Duration
+
+	// CheckPredecessorInterval is the period of the routine which
+	// checks that the node's predecessor is still alive.
+	CheckPredecessorInterval time.Duration
+
+	// ProbeInterval is the period of the routine which probes
+	// previously seen peers to detect other rings, e.g. after
+	// a partition, and merges them.
+	ProbeInterval time.Duration
+
+	// PingTimeout is how long the node waits for its successor or
+	// predecessor to answer a ping before considering it failed.
+	PingTimeout time.Duration
+
+	// SuccessorListSize is the number of successors each node keeps
+	// in its successor list (not including its immediate successor).
+	SuccessorListSize int
+
+	// DialTimeout is how long the node waits for a connection
+	// to a peer to be established.
+	DialTimeout time.Duration
+
+	// HandshakeTimeout is how long the node waits for the
+	// cryptographic handshake with a peer to complete.
+	HandshakeTimeout time.Duration
+
+	// RequestTimeout is how long the node waits for a peer
+	// to answer a request, e.g. during a lookup.
+	RequestTimeout time.Duration
+
+	// MaxFrameSize is the maximum size of the frames sent and
+	// accepted by the node.
+	MaxFrameSize uint32
+
+	// MaxStoreSize is the maximum total size in bytes of the
+	// values stored by the node, which any peer can send.
+	MaxStoreSize int
+
+	// MaxConnections is the maximum number of connections the node
+	// keeps open. Once it's reached, the least recently used one is
+	// closed to make room for a new one.
+	MaxConnections int
+
+	// IdleConnTimeout is how long a connection may be unused before
+	// the node closes it. Connections to the node's successor and
+	// predecessor are never closed for being idle.
+	IdleConnTimeout time.Duration
+
+	// BootstrapPeers are the addresses of the peers the node joins
+	// the ring through, tried in order.
+	BootstrapPeers []string
+
+	// KnownPeersPath is the path of the file which the peers the node
+	// has seen are saved to, so that it can rejoin the ring through
+	// them after a restart. The peers are not saved if it's empty.
+	KnownPeersPath string
+
+	// RejoinInterval is how long the node waits before trying to
+	// rejoin the ring once it has lost every successor. The interval
+	// doubles after every failed attempt, up to MaxRejoinInterval.
+	RejoinInterval    time.Duration
+	MaxRejoinInterval time.Duration
+}
+
+// DefaultConfig returns the default configuration of
+// a node listening on addr.
+func DefaultConfig(addr string) Config {
+	return Config{Addr: addr}.withDefaults()
+}
+
+func (c Config) withDefaults() Config {
+	if c.ListenAddr == "" {
+		c.ListenAddr = c.Addr
+	}
+	if c.Transport == nil {
+		c.Transport = transport.TCP{}
+	}
+	if c.Clock == nil {
+		c.Clock = clock.Real{}
+	}
+	if c.StabilizeInterval == 0 {
+		c.StabilizeInterval = DefaultStabilizeInterval
+	}
+	if c.FixFingersInterval == 0 {
+		c.FixFingersInterval = DefaultFixFingersInterval
+	}
+	if c.CheckPredecessorInterval == 0 {
+		c.CheckPredecessorInterval = DefaultCheckPredecessorInterval
+	}
+	if c.ProbeInterval == 0 {
+		c.ProbeInterval = DefaultProbeInterval
+	}
+	if c.PingTimeout == 0 {
+		c.PingTimeout = DefaultPingTimeout
+	}
+	if c.SuccessorListSize == 0 {
+		c.SuccessorListSize = DefaultSuccessorListSize
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DefaultRequestTimeout
+	}
+	if c.MaxFrameSize == 0 {
+		c.MaxFrameSize = message.DefaultMaxFrameSize
+	}
+	if c.MaxStoreSize == 0 {
+		c.MaxStoreSize = DefaultMaxStoreSize
+	}
+	if c.MaxConnections == 0 {
+		c.MaxConnections = DefaultMaxConnections
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if c.RejoinInterval == 0 {
+		c.RejoinInterval = DefaultRejoinInterval
+	}
+	if c.MaxRejoinInterval == 0 {
+		c.MaxRejoinInterval = DefaultMaxRejoinInterval
+	}
+
+	return c
+}
@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/clock"
+	"github.com/hasyimibhar/p2p-chat/transport"
+)
+
+func TestConfig_Defaults(t *testing.T) {
+	config := DefaultConfig("localhost:8000")
+
+	if config.Addr != "localhost:8000" || config.ListenAddr != "localhost:8000" {
+		t.Fatal("incorrect address")
+	}
+	if _, ok := config.Transport.(transport.TCP); !ok {
+		t.Fatal("expected TCP transport")
+	}
+	if _, ok := config.Clock.(clock.Real); !ok {
+		t.Fatal("expected wall clock")
+	}
+	if config.StabilizeInterval != DefaultStabilizeInterval || config.PingTimeout != DefaultPingTimeout ||
+		config.SuccessorListSize != DefaultSuccessorListSize || config.DialTimeout != DefaultDialTimeout ||
+		config.HandshakeTimeout != DefaultHandshakeTimeout || config.RequestTimeout != DefaultRequestTimeout ||
+		config.FixFingersInterval != DefaultFixFingersInterval ||
+		config.CheckPredecessorInterval != DefaultCheckPredecessorInterval ||
+		config.ProbeInterval != DefaultProbeInterval || config.RejoinInterval != DefaultRejoinInterval ||
+		config.MaxRejoinInterval != DefaultMaxRejoinInterval || config.MaxConnections != DefaultMaxConnections ||
+		config.IdleConnTimeout != DefaultIdleConnTimeout || config.MaxStoreSize != DefaultMaxStoreSize {
+		t.Fatal("incorrect default")
+	}
+
+	// Explicit values are kept
+	node, err := NewNode(Config{
+		Addr:              "node1",
+		StabilizeInterval: time.Second,
+		SuccessorListSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node.Config().StabilizeInterval != time.Second {
+		t.Fatal("stabilize interval was overridden")
+	}
+	if len(node.successors) != 5 {
+		t.Fatal("incorrect successor list size")
+	}
+	if node.Config().PingTimeout != DefaultPingTimeout {
+		t.Fatal("missing default ping timeout")
+	}
+}
+
+func TestConfig_InvalidSuccessorListSize(t *testing.T) {
+	if _, err := NewNode(Config{Addr: "node1", SuccessorListSize: -1}); err == nil {
+		t.Fatal("expected error for negative successor list size")
+	}
+}
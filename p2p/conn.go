@@ -0,0 +1,365 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/clock"
+	"github.com/hasyimibhar/p2p-chat/message"
+)
+
+// maxVerifiedAddrs is the maximum number of addresses
+// a node remembers having reached peers at.
+const maxVerifiedAddrs = 256
+
+// errHandshakeAborted is returned when the peer disconnects
+// during the handshake.
+var errHandshakeAborted = fmt.Errorf("peer disconnected during handshake")
+
+// dial is a connection attempt in progress. Concurrent attempts
+// to connect to the same address wait for it instead of dialing.
+type dial struct {
+	done chan struct{}
+	peer *Peer
+	err  error
+}
+
+// connectToPeer returns an authenticated connection to the peer at the
+// address, which must identify itself with expectedKey if it's not nil.
+// An open connection to the peer is reused, otherwise the node connects
+// to it and performs the cryptographic handshake.
+func (n *Node) connectToPeer(address string, expectedKey []byte) (*Peer, error) {
+	n.mtx.Lock()
+	if peer := n.openPeer(address, expectedKey); peer != nil {
+		n.mtx.Unlock()
+		return peer, nil
+	}
+
+	d, dialing := n.dials[address]
+	if !dialing {
+		d = &dial{done: make(chan struct{})}
+		n.dials[address] = d
+	}
+	n.mtx.Unlock()
+
+	if dialing {
+		<-d.done
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		if expectedKey != nil && !bytes.Equal(d.peer.PublicKey(), expectedKey) {
+			return nil, fmt.Errorf("peer identified itself as %s, expected %s",
+				base64.StdEncoding.EncodeToString(d.peer.PublicKey()),
+				base64.StdEncoding.EncodeToString(expectedKey))
+		}
+
+		return d.peer, nil
+	}
+
+	d.peer, d.err = n.dialPeer(address, expectedKey)
+
+	n.mtx.Lock()
+	delete(n.dials, address)
+	n.mtx.Unlock()
+	close(d.done)
+
+	return d.peer, d.err
+}
+
+// dialPeer opens a new connection to the peer at the address.
+func (n *Node) dialPeer(address string, expectedKey []byte) (*Peer, error) {
+	// log.Println("[trace] connecting to peer", address)
+
+	conn, err := n.config.Transport.Dial(address, n.config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := NewPeer(n, conn, true)
+	if err := n.performHandshake(peer, expectedKey); err != nil {
+		peer.Close()
+		return nil, err
+	}
+
+	// The peer has just been reached at the address, but it may
+	// advertise another one
+	n.markAddrVerified(address, peer.PublicKey())
+	if err := n.verifyAddr(peer); err != nil {
+		peer.Close()
+		return nil, err
+	}
+
+	n.rememberPeer(peer)
+
+	if err := n.addPeer(peer); err != nil {
+		peer.Close()
+		return nil, err
+	}
+
+	go n.handleMessages(peer)
+
+	return peer, nil
+}
+
+// verifyAddr checks that the peer can be reached at the address it
+// advertises, before the address is stored or handed out to other
+// peers. The node connects back to the address, and checks that the
+// peer answers the handshake there. Each address is only checked the
+// first time it's advertised with the peer's public key.
+func (n *Node) verifyAddr(peer *Peer) error {
+	address, key := peer.ListenAddr(), peer.PublicKey()
+
+	n.mtx.Lock()
+	verified := bytes.Equal(n.reachedAddrs[address], key)
+	n.mtx.Unlock()
+
+	if verified {
+		return nil
+	}
+
+	conn, err := n.config.Transport.Dial(address, n.config.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("peer is unreachable at its advertised address %s: %s", address, err)
+	}
+
+	probe := NewPeer(n, conn, true)
+	defer probe.Close()
+
+	if err := n.probeHandshake(probe, key); err != nil {
+		return fmt.Errorf("peer is unreachable at its advertised address %s: %s", address, err)
+	}
+
+	n.markAddrVerified(address, key)
+	return nil
+}
+
+// probeHandshake checks that the peer answers the node's handshake
+// challenge with the key. Unlike performHandshake, the node doesn't
+// identify itself in turn, so that the peer doesn't take the connection
+// for one it can use.
+func (n *Node) probeHandshake(peer *Peer, key []byte) error {
+	timeout := n.config.Clock.After(n.config.HandshakeTimeout)
+
+	challenge, err := message.NewHandshakeChallenge(SupportedCapabilities)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.SendMessage(challenge); err != nil {
+		return err
+	}
+
+	msg, err := receiveHandshakeMessage(peer, timeout)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := msg.(message.HandshakeChallenge); !ok {
+		return fmt.Errorf("peer did not send a handshake challenge")
+	}
+
+	if msg, err = receiveHandshakeMessage(peer, timeout); err != nil {
+		return err
+	}
+
+	handshake, ok := msg.(message.Handshake)
+	if !ok {
+		return fmt.Errorf("peer did not send a handshake")
+	}
+
+	if err := handshake.Verify(); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(handshake.Challenge, challenge.Nonce) {
+		return fmt.Errorf("handshake does not answer our challenge")
+	}
+
+	if !bytes.Equal(handshake.PublicKey, key) {
+		return fmt.Errorf("peer identified itself as %s, expected %s",
+			base64.StdEncoding.EncodeToString(handshake.PublicKey),
+			base64.StdEncoding.EncodeToString(key))
+	}
+
+	return nil
+}
+
+// markAddrVerified records that the peer with the public key
+// has been reached at the address.
+func (n *Node) markAddrVerified(address string, key []byte) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if _, ok := n.reachedAddrs[address]; !ok && len(n.reachedAddrs) >= maxVerifiedAddrs {
+		// Make room by forgetting an arbitrary address
+		for a := range n.reachedAddrs {
+			delete(n.reachedAddrs, a)
+			break
+		}
+	}
+
+	n.reachedAddrs[address] = key
+}
+
+// request sends the request to the peer and waits for its response
+// until the timeout elapses on the node's clock.
+func (n *Node) request(peer *Peer, msg message.Message, opcode message.Opcode, timeout time.Duration) (message.Message, error) {
+	ctx, cancel := clock.WithTimeout(context.Background(), n.config.Clock, timeout)
+	defer cancel()
+
+	return peer.Request(ctx, msg, opcode)
+}
+
+// openPeer returns the open connection to the peer at the address,
+// or nil if there is none. A connection which has just been lost may
+// not have been removed yet, so it's skipped. The node's lock must be
+// held.
+func (n *Node) openPeer(address string, key []byte) *Peer {
+	if key != nil {
+		if peer, ok := n.peers[string(key)]; ok && peer.ListenAddr() == address && !peer.disconnected() {
+			return peer
+		}
+
+		return nil
+	}
+
+	for _, peer := range n.peers {
+		if peer.ListenAddr() == address && !peer.disconnected() {
+			return peer
+		}
+	}
+
+	return nil
+}
+
+// addPeer adds an authenticated connection to the connections managed
+// by the node. If the node has reached its connection limit, the least
+// recently used connection is closed to make room.
+//
+// If both peers connect to each other at the same time, they end up
+// with two connections. Both keep using the one opened by the peer
+// with the lower public key, and the other one is closed once idle.
+func (n *Node) addPeer(peer *Peer) error {
+	n.mtx.Lock()
+
+	var evicted *Peer
+	if len(n.conns) >= n.config.MaxConnections {
+		if evicted = n.leastRecentlyUsedPeer(); evicted == nil {
+			n.mtx.Unlock()
+			return fmt.Errorf("too many connections")
+		}
+
+		n.removePeerLocked(evicted)
+	}
+
+	n.conns[peer] = true
+
+	key := string(peer.PublicKey())
+	if existing, ok := n.peers[key]; !ok || n.preferPeer(peer, existing) {
+		n.peers[key] = peer
+	}
+	n.mtx.Unlock()
+
+	if evicted != nil {
+		log.Println("[info] too many connections, closing connection to", evicted.ListenAddr())
+		evicted.Close()
+	}
+
+	return nil
+}
+
+// preferPeer returns whether the connection should be used instead of
+// an existing one to the same peer. If the peer has moved to another
+// address, only the newer connection reaches it.
+func (n *Node) preferPeer(peer *Peer, existing *Peer) bool {
+	if peer.ListenAddr() != existing.ListenAddr() {
+		return true
+	}
+
+	lowerKey := bytes.Compare(n.pubkey, peer.PublicKey()) < 0
+	return peer.initiator == lowerKey && existing.initiator != lowerKey
+}
+
+// removePeer stops managing the connection, e.g. once it's closed.
+func (n *Node) removePeer(peer *Peer) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.removePeerLocked(peer)
+}
+
+func (n *Node) removePeerLocked(peer *Peer) {
+	delete(n.conns, peer)
+
+	key := string(peer.PublicKey())
+	if n.peers[key] != peer {
+		return
+	}
+
+	delete(n.peers, key)
+
+	// Fall back to another connection to the peer, if any
+	for p := range n.conns {
+		if string(p.PublicKey()) == key {
+			n.peers[key] = p
+			break
+		}
+	}
+}
+
+// pinned returns whether the connection is to the node's successor or
+// predecessor, which is never closed to make room or for being idle.
+// The node's lock must be held.
+func (n *Node) pinned(peer *Peer) bool {
+	return peer == n.successor || peer == n.predecessorPeer
+}
+
+// leastRecentlyUsedPeer returns the connection which has been unused
+// for the longest time, or nil if every connection is pinned. The
+// node's lock must be held.
+func (n *Node) leastRecentlyUsedPeer() *Peer {
+	var lru *Peer
+	for p := range n.conns {
+		if !n.pinned(p) && (lru == nil || p.LastActive().Before(lru.LastActive())) {
+			lru = p
+		}
+	}
+
+	return lru
+}
+
+func (n *Node) handleEvictIdle() {
+	for {
+		select {
+		case <-n.config.Clock.After(n.config.IdleConnTimeout):
+			n.evictIdle()
+
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+// evictIdle closes the connections which have not been used
+// for IdleConnTimeout.
+func (n *Node) evictIdle() {
+	now := n.config.Clock.Now()
+
+	n.mtx.Lock()
+	idle := []*Peer{}
+	for p := range n.conns {
+		if !n.pinned(p) && now.Sub(p.LastActive()) >= n.config.IdleConnTimeout {
+			idle = append(idle, p)
+		}
+	}
+	n.mtx.Unlock()
+
+	for _, p := range idle {
+		p.Close()
+	}
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/transport"
+)
+
+func listeningNode(t *testing.T, network *transport.Memory, config Config) *Node {
+	config.Transport = network
+
+	node, err := NewNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node.ListenForConnections()
+	waitForListener(t, network, node.Config().ListenAddr)
+
+	return node
+}
+
+func connCount(n *Node) int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return len(n.conns)
+}
+
+func TestNode_ConnectToPeerReusesConnection(t *testing.T) {
+	network := transport.NewMemory()
+
+	node1 := listeningNode(t, network, Config{Addr: "node1"})
+	defer node1.Close()
+
+	node2 := listeningNode(t, network, Config{Addr: "node2"})
+	defer node2.Close()
+
+	// Simultaneous attempts share a single dial
+	peers := make([]*Peer, 8)
+	errs := make([]error, len(peers))
+
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peers[i], errs[i] = node2.connectToPeer(node1.Addr(), node1.PublicKey())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range peers {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if peers[i] != peers[0] {
+			t.Fatal("simultaneous attempts opened different connections")
+		}
+	}
+
+	// The open connection is reused
+	peer, err := node2.connectToPeer(node1.Addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer != peers[0] {
+		t.Fatal("open connection was not reused")
+	}
+
+	if n := connCount(node2); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	// The peer's identity is still checked
+	if _, err := node2.connectToPeer(node1.Addr(), node2.PublicKey()); err == nil {
+		t.Fatal("expected error for unexpected public key")
+	}
+}
+
+func TestNode_MaxConnections(t *testing.T) {
+	network := transport.NewMemory()
+
+	node := listeningNode(t, network, Config{Addr: "node0", MaxConnections: 2})
+	defer node.Close()
+
+	peers := []*Peer{}
+	for i := 1; i <= 3; i++ {
+		other := listeningNode(t, network, Config{Addr: fmt.Sprintf("node%d", i)})
+		defer other.Close()
+
+		peer, err := node.connectToPeer(other.Addr(), other.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, peer)
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := connCount(node); n != 2 {
+		t.Fatalf("expected 2 connections, got %d", n)
+	}
+
+	// The least recently used connection made room
+	select {
+	case <-peers[0].closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("least recently used connection was not closed")
+	}
+}
+
+func TestNode_RejectUnreachableAdvertisedAddress(t *testing.T) {
+	network := transport.NewMemory()
+
+	node1 := listeningNode(t, network, Config{Addr: "node1"})
+	defer node1.Close()
+
+	// The node listens at another address than the one it advertises
+	node2 := listeningNode(t, network, Config{Addr: "node2", ListenAddr: "node2-listen"})
+	defer node2.Close()
+
+	peer, err := node2.connectToPeer(node1.Addr(), node1.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-peer.closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("peer with an unreachable address was not rejected")
+	}
+
+	node1.mtx.Lock()
+	_, known := node1.knownPeers[node2.Addr()]
+	node1.mtx.Unlock()
+
+	if known || connCount(node1) != 0 {
+		t.Fatal("unreachable address was stored")
+	}
+}
+
+func TestNode_ProbeHandshake(t *testing.T) {
+	network := transport.NewMemory()
+
+	node1 := listeningNode(t, network, Config{Addr: "node1"})
+	defer node1.Close()
+
+	node2 := listeningNode(t, network, Config{Addr: "node2"})
+	defer node2.Close()
+
+	conn, err := network.Dial(node1.Addr(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := NewPeer(node2, conn, true)
+	if err := node2.probeHandshake(probe, node1.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	probe.Close()
+
+	// The probed node must not take the connection for a peer
+	time.Sleep(50 * time.Millisecond)
+
+	node1.mtx.Lock()
+	_, known := node1.knownPeers[node2.Addr()]
+	node1.mtx.Unlock()
+
+	if known || connCount(node1) != 0 {
+		t.Fatal("probe was taken for a peer")
+	}
+
+	conn, err = network.Dial(node1.Addr(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe = NewPeer(node2, conn, true)
+	defer probe.Close()
+
+	if err := node2.probeHandshake(probe, node2.PublicKey()); err == nil {
+		t.Fatal("expected probe to fail with the wrong key")
+	}
+}
@@ -0,0 +1,225 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/hasyimibhar/p2p-chat/message"
+)
+
+var (
+	// ErrKeyNotFound is returned by Get if no value is stored for the key.
+	ErrKeyNotFound = fmt.Errorf("key not found")
+
+	// ErrStoreFull is returned by Put if the node responsible for the
+	// key has reached MaxStoreSize.
+	ErrStoreFull = fmt.Errorf("store is full")
+)
+
+// Put stores the value of the key in the network. The value is stored
+// on the node responsible for the key, i.e. the successor of the key's
+// ID, and replicated to the nodes in its successor list, so that it
+// survives as many failures as the ring itself.
+func (n *Node) Put(key []byte, value []byte) error {
+	id := IDFromKey(key)
+
+	addr, pubkey, err := n.Lookup(id)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(pubkey, n.pubkey) {
+		if err := n.storeValue(id, value); err != nil {
+			return err
+		}
+
+		n.replicate(id, value)
+		return nil
+	}
+
+	peer, err := n.connectToPeer(addr, pubkey)
+	if err != nil {
+		return err
+	}
+
+	request := message.StoreRequest{Key: id[:], Value: value}
+	msg, err := n.request(peer, request, message.OpcodeStoreResponse, n.config.RequestTimeout)
+	if err != nil {
+		return fmt.Errorf("store at %s failed: %s", addr, err)
+	}
+
+	if !msg.(message.StoreResponse).Stored {
+		return ErrStoreFull
+	}
+
+	return nil
+}
+
+// Get returns the value of the key stored in the network,
+// or ErrKeyNotFound if there is none.
+func (n *Node) Get(key []byte) ([]byte, error) {
+	id := IDFromKey(key)
+
+	addr, pubkey, err := n.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(pubkey, n.pubkey) {
+		value, ok := n.fetchValue(id)
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+
+		return value, nil
+	}
+
+	peer, err := n.connectToPeer(addr, pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := n.request(peer, message.FetchRequest{Key: id[:]}, message.OpcodeFetchResponse, n.config.RequestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("fetch at %s failed: %s", addr, err)
+	}
+
+	response := msg.(message.FetchResponse)
+	if !response.Found {
+		return nil, ErrKeyNotFound
+	}
+
+	return response.Value, nil
+}
+
+// storeValue stores the value of the key with the ID, unless the
+// total size of the stored values would exceed MaxStoreSize.
+func (n *Node) storeValue(id ID, value []byte) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	size := n.storeSize - len(n.store[id]) + len(value)
+	if size > n.config.MaxStoreSize {
+		return ErrStoreFull
+	}
+
+	n.store[id] = value
+	n.storeSize = size
+	return nil
+}
+
+func (n *Node) fetchValue(id ID) ([]byte, bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	value, ok := n.store[id]
+	return value, ok
+}
+
+// replicate copies the value to the nodes in the successor list.
+func (n *Node) replicate(id ID, value []byte) {
+	successor := n.Successor()
+	if successor == nil {
+		return
+	}
+
+	err := successor.SendMessage(message.Replicate{
+		Count: n.config.SuccessorListSize - 1,
+		Key:   id[:],
+		Value: value,
+	})
+	if err != nil {
+		log.Println("[error] replicate failed:", err)
+	}
+}
+
+func (n *Node) handleStoreRequest(peer *Peer, requestID uint32, msg message.StoreRequest) error {
+	id := IDFromBytes(msg.Key)
+
+	if err := n.storeValue(id, msg.Value); err != nil {
+		return peer.Respond(requestID, message.StoreResponse{Stored: false})
+	}
+
+	n.replicate(id, msg.Value)
+	return peer.Respond(requestID, message.StoreResponse{Stored: true})
+}
+
+func (n *Node) handleReplicate(msg message.Replicate) error {
+	stored := n.storeValue(IDFromBytes(msg.Key), msg.Value)
+
+	// The count comes from the peer, so it's capped to keep
+	// a forged one from sending the value around the ring
+	// over and over again
+	if max := n.config.SuccessorListSize - 1; msg.Count > max {
+		msg.Count = max
+	}
+
+	if msg.Count > 0 && n.Successor() != nil {
+		msg.Count--
+		if err := n.Successor().SendMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	return stored
+}
+
+func (n *Node) handleFetchRequest(peer *Peer, requestID uint32, msg message.FetchRequest) error {
+	value, ok := n.fetchValue(IDFromBytes(msg.Key))
+
+	return peer.Respond(requestID, message.FetchResponse{
+		Found: ok,
+		Value: value,
+	})
+}
+
+// handoff is called when the node's predecessor changes. If a node
+// has joined in between, the values it's now responsible for are
+// handed off to it. The node keeps them, since it's the first node
+// of their replicas.
+func (n *Node) handoff(predecessor *Peer) {
+	predecessorID := IDFromPublicKey(predecessor.PublicKey())
+
+	n.mtx.Lock()
+	values := map[ID][]byte{}
+	for id, value := range n.store {
+		if !id.BetweenRightInclusive(predecessorID, n.id) {
+			values[id] = value
+		}
+	}
+	n.mtx.Unlock()
+
+	for id, value := range values {
+		if err := predecessor.SendMessage(message.Replicate{Key: id[:], Value: value}); err != nil {
+			log.Println("[error] handoff failed:", err)
+			return
+		}
+	}
+
+	n.replicateOwned()
+}
+
+// replicateOwned replicates the values the node is responsible for
+// again, since the nodes in its successor list may have changed, e.g.
+// if a node has left and the node has taken over its values.
+func (n *Node) replicateOwned() {
+	n.mtx.Lock()
+	if n.predecessorKey == nil {
+		n.mtx.Unlock()
+		return
+	}
+
+	predecessorID := IDFromPublicKey(n.predecessorKey)
+	values := map[ID][]byte{}
+	for id, value := range n.store {
+		if id.BetweenRightInclusive(predecessorID, n.id) {
+			values[id] = value
+		}
+	}
+	n.mtx.Unlock()
+
+	for id, value := range values {
+		n.replicate(id, value)
+	}
+}
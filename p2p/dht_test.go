@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/hasyimibhar/p2p-chat/message"
+)
+
+func TestNode_MaxStoreSize(t *testing.T) {
+	node, err := NewNode(Config{Addr: "node1", MaxStoreSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The node is alone, so it stores every key
+	if err := node.Put([]byte("a"), make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Put([]byte("b"), make([]byte, 5)); err != ErrStoreFull {
+		t.Fatal("expected store to be full, got", err)
+	}
+
+	// Replacing a value only counts the difference in size
+	if err := node.Put([]byte("a"), make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := node.Get([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 10 {
+		t.Fatal("incorrect value")
+	}
+}
+
+func TestNode_ReplicateCountIsCapped(t *testing.T) {
+	peer1, peer2 := pipePeers(t)
+	defer peer1.Close()
+	defer peer2.Close()
+
+	node := peer1.node
+	node.successor = peer1
+
+	forged := message.Replicate{
+		Count: math.MaxInt32,
+		Key:   bytes.Repeat([]byte{1}, IDSize),
+		Value: []byte("value"),
+	}
+
+	errCh := make(chan error)
+	go func() { errCh <- node.handleReplicate(forged) }()
+
+	msg := (<-peer2.Incoming()).Message.(message.Replicate)
+	if msg.Count != node.Config().SuccessorListSize-2 {
+		t.Fatalf("replicate was passed on with count %d", msg.Count)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"log"
+)
+
+// fingerTableSize is the number of fingers of each node, one for
+// every bit of the ID. The i-th finger of a node is the successor of
+// the node's ID + 2^i, which allows lookups to halve the remaining
+// distance to an ID at every hop.
+const fingerTableSize = IDSize * 8
+
+// closestPrecedingFinger returns the finger which most closely
+// precedes the ID, or false if none of the fingers is between
+// the node and the ID.
+func (n *Node) closestPrecedingFinger(id ID) (remoteNode, bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for i := len(n.fingers) - 1; i >= 0; i-- {
+		f := n.fingers[i]
+		if f.addr != "" && f.id.Between(n.id, id) {
+			return f, true
+		}
+	}
+
+	return remoteNode{}, false
+}
+
+// removeFinger removes all entries of the peer with the public
+// key from the finger table, e.g. because it can't be contacted.
+func (n *Node) removeFinger(key []byte) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	id := IDFromPublicKey(key)
+	for i := range n.fingers {
+		if n.fingers[i].addr != "" && n.fingers[i].id == id {
+			n.fingers[i] = remoteNode{}
+		}
+	}
+}
+
+func (n *Node) handleFixFingers() {
+	for {
+		select {
+		case <-n.config.Clock.After(n.config.FixFingersInterval):
+			go func() {
+				if err := n.fixFingers(); err != nil {
+					log.Println("[error] fix fingers failed:", err)
+				}
+			}()
+
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+// fixFingers refreshes the next finger of the finger table. Since the
+// successor of a finger's start is often the successor of the next
+// fingers' starts as well, those are updated without further lookups.
+func (n *Node) fixFingers() error {
+	n.mtx.Lock()
+	next := n.nextFinger
+	n.mtx.Unlock()
+
+	addr, key, err := n.Lookup(n.id.fingerStart(next))
+	if err != nil {
+		return err
+	}
+
+	f := remoteNode{addr: addr, key: key, id: IDFromPublicKey(key)}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for {
+		n.fingers[next] = f
+		next = (next + 1) % fingerTableSize
+
+		if next == 0 || f.id == n.id || !n.id.fingerStart(next).BetweenRightInclusive(n.id, f.id) {
+			break
+		}
+	}
+
+	n.nextFinger = next
+	return nil
+}
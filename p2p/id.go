@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+)
+
+// IDSize is the size of node IDs in bytes.
+const IDSize = sha256.Size
+
+// ID is the position of a node on the ring, derived from its public
+// key so that a node cannot choose where it's placed.
+type ID [IDSize]byte
+
+// ringSize is the number of IDs on the ring, i.e. 2^(IDSize*8).
+var ringSize = new(big.Int).Lsh(big.NewInt(1), IDSize*8)
+
+// IDFromPublicKey returns the ID of the node with the public key.
+func IDFromPublicKey(pubkey []byte) ID {
+	return ID(sha256.Sum256(pubkey))
+}
+
+// IDFromKey returns the ID of a key stored in the DHT.
+func IDFromKey(key []byte) ID {
+	return ID(sha256.Sum256(key))
+}
+
+// IDFromBytes converts an encoded ID, e.g. received from a peer.
+func IDFromBytes(buf []byte) ID {
+	var id ID
+	copy(id[:], buf)
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:8])
+}
+
+// Between returns true if id is in the interval (a, b) of the ring.
+// If a == b, the interval is the whole ring except a.
+func (id ID) Between(a ID, b ID) bool {
+	switch bytes.Compare(a[:], b[:]) {
+	case -1:
+		return bytes.Compare(a[:], id[:]) < 0 && bytes.Compare(id[:], b[:]) < 0
+	case 1:
+		// The interval wraps around zero
+		return bytes.Compare(a[:], id[:]) < 0 || bytes.Compare(id[:], b[:]) < 0
+	default:
+		return id != a
+	}
+}
+
+// BetweenRightInclusive returns true if id is in the interval (a, b]
+// of the ring. If a == b, the interval is the whole ring.
+func (id ID) BetweenRightInclusive(a ID, b ID) bool {
+	return id == b || id.Between(a, b)
+}
+
+// fingerStart returns the start of the i-th finger of the node with
+// the ID, i.e. id + 2^i, wrapping around the ring.
+func (id ID) fingerStart(i int) ID {
+	start := new(big.Int).SetBytes(id[:])
+	start.Add(start, new(big.Int).Lsh(big.NewInt(1), uint(i)))
+	start.Mod(start, ringSize)
+
+	var result ID
+	start.FillBytes(result[:])
+	return result
+}
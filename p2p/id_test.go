@@ -0,0 +1,76 @@
+package p2p
+
+import (
+	"testing"
+)
+
+func TestID_Between(t *testing.T) {
+	id := func(b byte) ID {
+		var id ID
+		id[0] = b
+		return id
+	}
+
+	tests := []struct {
+		ID             ID
+		A, B           ID
+		Between        bool
+		RightInclusive bool
+	}{
+		{id(5), id(1), id(10), true, true},
+		{id(1), id(1), id(10), false, false},
+		{id(10), id(1), id(10), false, true},
+		{id(20), id(1), id(10), false, false},
+
+		// Wrapping around zero
+		{id(250), id(200), id(10), true, true},
+		{id(5), id(200), id(10), true, true},
+		{id(100), id(200), id(10), false, false},
+		{id(10), id(200), id(10), false, true},
+
+		// Whole ring
+		{id(5), id(1), id(1), true, true},
+		{id(1), id(1), id(1), false, true},
+	}
+
+	for _, tt := range tests {
+		if tt.ID.Between(tt.A, tt.B) != tt.Between {
+			t.Fatalf("%d in (%d, %d) should be %v", tt.ID[0], tt.A[0], tt.B[0], tt.Between)
+		}
+
+		if tt.ID.BetweenRightInclusive(tt.A, tt.B) != tt.RightInclusive {
+			t.Fatalf("%d in (%d, %d] should be %v", tt.ID[0], tt.A[0], tt.B[0], tt.RightInclusive)
+		}
+	}
+}
+
+func TestIDFromPublicKey(t *testing.T) {
+	node1, _ := NewNode(Config{Addr: "node1"})
+	node2, _ := NewNodeWithKey(Config{Addr: "node2"}, node1.PrivateKey(), node1.PublicKey())
+
+	if node1.ID() != node2.ID() {
+		t.Fatal("ID is not derived from the public key")
+	}
+
+	if node1.ID() != IDFromPublicKey(node1.PublicKey()) {
+		t.Fatal("incorrect ID")
+	}
+}
+
+func TestID_FingerStart(t *testing.T) {
+	var id ID
+	id[IDSize-1] = 0xff
+
+	start := id.fingerStart(0)
+	if start[IDSize-1] != 0 || start[IDSize-2] != 1 {
+		t.Fatal("carry was not propagated")
+	}
+
+	id = ID{}
+	id[0] = 0x80
+
+	start = id.fingerStart(IDSize*8 - 1)
+	if start != (ID{}) {
+		t.Fatal("finger start did not wrap around the ring")
+	}
+}
@@ -0,0 +1,301 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/hasyimibhar/p2p-chat/message"
+)
+
+const (
+	// maxKnownPeers is the maximum number of previously seen
+	// peers remembered by a node.
+	maxKnownPeers = 64
+
+	// chatLogOverhead is an upper bound on the size of a ChatLog
+	// frame apart from its entries, i.e. the sequence number, the
+	// authentication tag, the opcode and the entry count.
+	chatLogOverhead = 64
+)
+
+// rememberPeer adds the peer to the peers the node has seen,
+// which are probed to detect other rings, and which the node
+// rejoins the ring through if it gets cut off.
+func (n *Node) rememberPeer(peer *Peer) {
+	address := peer.ListenAddr()
+	if address == "" || address == n.Addr() {
+		return
+	}
+
+	n.mtx.Lock()
+	known, ok := n.knownPeers[address]
+	if !ok && len(n.knownPeers) >= maxKnownPeers {
+		// Make room by forgetting an arbitrary peer
+		for a := range n.knownPeers {
+			delete(n.knownPeers, a)
+			break
+		}
+	}
+
+	n.knownPeers[address] = peer.PublicKey()
+	n.mtx.Unlock()
+
+	if !ok || !bytes.Equal(known, peer.PublicKey()) {
+		if err := n.saveKnownPeers(); err != nil {
+			log.Println("[error] save known peers failed:", err)
+		}
+	}
+}
+
+// nextKnownPeer returns the next peer to probe, going through the
+// known peers in turn. The node's successor is skipped, since it's
+// in the node's ring by definition.
+func (n *Node) nextKnownPeer() (string, []byte, bool) {
+	successor := ""
+	if s := n.Successor(); s != nil {
+		successor = s.ListenAddr()
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	addresses := []string{}
+	for address := range n.knownPeers {
+		if address != successor {
+			addresses = append(addresses, address)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return "", nil, false
+	}
+
+	sort.Strings(addresses)
+	n.nextProbe = (n.nextProbe + 1) % len(addresses)
+
+	address := addresses[n.nextProbe]
+	return address, n.knownPeers[address], true
+}
+
+// closestKnownPeers returns the known peers, ordered by their
+// distance from the node along the ring.
+func (n *Node) closestKnownPeers() []remoteNode {
+	n.mtx.Lock()
+	peers := []remoteNode{}
+	for address, key := range n.knownPeers {
+		peers = append(peers, remoteNode{addr: address, key: key, id: IDFromPublicKey(key)})
+	}
+	n.mtx.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].id.Between(n.id, peers[j].id)
+	})
+
+	return peers
+}
+
+func (n *Node) handleProbe() {
+	for {
+		select {
+		case <-n.config.Clock.After(n.config.ProbeInterval):
+			go func() {
+				if err := n.probe(); err != nil {
+					log.Println("[error] merge failed:", err)
+				}
+			}()
+
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+// probe asks one of the peers the node has seen before for the
+// successor of the node's ID. If both are in the same ring, that's
+// the node itself. Any other answer means that the peer belongs to
+// another ring, e.g. after a partition has healed, so the rings
+// must be merged.
+func (n *Node) probe() error {
+	address, key, ok := n.nextKnownPeer()
+	if !ok {
+		return nil
+	}
+
+	_, successorKey, err := n.findSuccessor(address, key, n.id)
+	if err != nil {
+		// The peer may have left, or still be unreachable
+		return nil
+	}
+
+	if bytes.Equal(successorKey, n.pubkey) {
+		return nil
+	}
+
+	log.Printf("[info] peer %s belongs to another ring, merging", address)
+
+	return n.merge(message.Merge{
+		Initiator:  n.pubkey,
+		ContactKey: key,
+		Contact:    address,
+	})
+}
+
+// merge handles a Merge: the node looks up its successor in the other
+// ring, and switches to it if it's closer than its current successor.
+// The Merge is passed on to the node's successor in its own ring, until
+// it has gone around the ring. Nodes which are already in the other ring
+// don't pass it on, so that it doesn't circle the other ring forever.
+func (n *Node) merge(msg message.Merge) error {
+	address, key, err := n.findSuccessor(msg.Contact, msg.ContactKey, n.id)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(key, n.pubkey) {
+		return nil
+	}
+
+	successor := n.Successor()
+	if successor != nil && !bytes.Equal(successor.PublicKey(), msg.Initiator) {
+		if err := successor.SendMessage(msg); err != nil {
+			log.Println("[error] propagate merge failed:", err)
+		}
+	}
+
+	if successor != nil && !IDFromPublicKey(key).Between(n.id, IDFromPublicKey(successor.PublicKey())) {
+		return nil
+	}
+
+	return n.setSuccessor(address, key)
+}
+
+// chatLogMessages returns the node's chat log split into messages
+// which each fit in a frame.
+func (n *Node) chatLogMessages() []message.ChatLog {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	chunks := []message.ChatLog{}
+	chunk := message.ChatLog{Entries: []message.Chat{}}
+	size := chatLogOverhead
+
+	for _, e := range n.chatLog {
+		// Each entry is prefixed with its length
+		entrySize := 4 + len(e.PublicKey) + len(e.Nonce) + len(e.Signature) + len(e.Text)
+
+		full := size+entrySize > int(n.config.MaxFrameSize) || len(chunk.Entries) == math.MaxUint16
+		if full && len(chunk.Entries) > 0 {
+			chunks = append(chunks, chunk)
+			chunk = message.ChatLog{Entries: []message.Chat{}}
+			size = chatLogOverhead
+		}
+
+		chunk.Entries = append(chunk.Entries, message.Chat{
+			PublicKey: e.PublicKey,
+			Nonce:     e.Nonce,
+			Text:      e.Text,
+			Signature: e.Signature,
+		})
+		size += entrySize
+	}
+
+	if len(chunk.Entries) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// sendChatLog sends the node's chat log to the peer,
+// in as many messages as needed.
+func (n *Node) sendChatLog(peer *Peer) error {
+	for _, chatLog := range n.chatLogMessages() {
+		if err := peer.SendMessage(chatLog); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeChatLog adds the entries of a chat log received from the peer
+// which are missing from the node's chat log. If any entry was missing,
+// the node passes its chat log on to its successor, so that the entries
+// spread around the ring until every node has them. Since the successor
+// may send its chat log over the same connection, it's skipped only if
+// it already has every entry.
+func (n *Node) mergeChatLog(peer *Peer, chatLog message.ChatLog) {
+	n.mtx.Lock()
+	received := map[string]bool{}
+	added, rejected := 0, 0
+	for _, e := range chatLog.Entries {
+		key := chatEntryKey(e.PublicKey, e.Nonce)
+		received[key] = true
+		if n.chatKeys[key] {
+			continue
+		}
+
+		if err := e.Verify(); err != nil {
+			rejected++
+			continue
+		}
+
+		n.addChatEntry(ChatEntry{
+			PublicKey: e.PublicKey,
+			Nonce:     e.Nonce,
+			Text:      e.Text,
+			Signature: e.Signature,
+		})
+		added++
+
+		log.Printf("[%s] %s", base64.StdEncoding.EncodeToString(e.PublicKey), e.Text)
+	}
+
+	// Entries the peer doesn't have yet
+	missing := 0
+	for _, e := range n.chatLog {
+		if !received[chatEntryKey(e.PublicKey, e.Nonce)] {
+			missing++
+		}
+	}
+	n.mtx.Unlock()
+
+	if rejected > 0 {
+		log.Printf("[warn] rejected %d chat log entries with invalid signatures from %s",
+			rejected, peer.ListenAddr())
+	}
+
+	if added == 0 {
+		return
+	}
+
+	if successor := n.Successor(); successor != nil && (successor != peer || missing > 0) {
+		if err := n.sendChatLog(successor); err != nil {
+			log.Println("[error] propagate chat log failed:", err)
+		}
+	}
+}
+
+// addChatEntry appends the entry to the node's chat log, unless the
+// node already has it, in which case it returns false. Entries are
+// identified by their author and nonce, so that identical messages
+// sent by the same author are kept apart. The node's mutex must be
+// held.
+func (n *Node) addChatEntry(entry ChatEntry) bool {
+	key := chatEntryKey(entry.PublicKey, entry.Nonce)
+	if n.chatKeys[key] {
+		return false
+	}
+
+	n.chatKeys[key] = true
+	n.chatLog = append(n.chatLog, entry)
+	return true
+}
+
+// chatEntryKey identifies a chat message by its author and nonce.
+func chatEntryKey(pubkey []byte, nonce []byte) string {
+	return string(pubkey) + string(nonce)
+}
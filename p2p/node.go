@@ -0,0 +1,1402 @@
+// Package p2p implements the chat node, which joins a Chord-like ring of
+// peers and relays chat messages around it.
+package p2p
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"github.com/hasyimibhar/p2p-chat/message"
+	"github.com/hasyimibhar/p2p-chat/ratchet"
+	"github.com/hasyimibhar/p2p-chat/x25519"
+)
+
+const (
+	// SupportedCapabilities are the protocol features
+	// implemented by this node.
+	SupportedCapabilities = message.CapSignedChat | message.CapRatchet
+
+	// RequiredCapabilities are the protocol features that
+	// a peer must support to be accepted.
+	RequiredCapabilities = message.CapSignedChat
+
+	// maxLookupHops is the maximum number of peers
+	// visited by a lookup before giving up.
+	maxLookupHops = 256
+)
+
+// ratchetKeyPair is the initial ratchet key pair of a private
+// chat session which has been requested but not yet established.
+type ratchetKeyPair struct {
+	privkey []byte
+	pubkey  []byte
+}
+
+type ChatEntry struct {
+	PublicKey []byte
+	Nonce     []byte
+	Text      string
+	Signature []byte
+}
+
+// remoteNode is the address and public key of another node,
+// e.g. an entry of the finger table or the successor list.
+type remoteNode struct {
+	addr string
+	key  []byte
+	id   ID
+}
+
+// Node represents the active peer.
+type Node struct {
+	pubkey  []byte
+	privkey []byte
+	id      ID
+	config  Config
+
+	// agreementPubkey and agreementPrivkey are the X25519 key pair
+	// used for key agreement. It's generated on startup and certified
+	// by the node's Ed25519 identity key during the handshake.
+	agreementPubkey  []byte
+	agreementPrivkey []byte
+
+	ln           net.Listener
+	mtx          sync.Mutex
+	successor    *Peer
+	successors   []remoteNode
+	fingers      []remoteNode
+	nextFinger   int
+	sessions     map[string]*ratchet.Session
+	pendingChats map[string]ratchetKeyPair
+	chatLog      []ChatEntry
+	chatKeys     map[string]bool
+	store        map[ID][]byte
+	storeSize    int
+	knownPeers   map[string][]byte
+	nextProbe    int
+	rejoining    bool
+	saveMtx      sync.Mutex
+	conns        map[*Peer]bool
+	peers        map[string]*Peer
+	dials        map[string]*dial
+	reachedAddrs map[string][]byte
+	chatMessages chan ChatEntry
+	privateChats chan ChatEntry
+	stabilizeCh  chan struct{}
+	stabilizeMtx sync.Mutex
+	maintainOnce sync.Once
+	closeCh      chan struct{}
+
+	// predecessor and predecessorKey are the address and public
+	// key of the node's predecessor, or empty if it's unknown.
+	// predecessorPeer is the connection over which the predecessor
+	// notified the node.
+	predecessor     string
+	predecessorKey  []byte
+	predecessorPeer *Peer
+}
+
+// NewNode creates a new node with a freshly generated key pair.
+func NewNode(config Config) (*Node, error) {
+	privkey, pubkey, err := ed25519.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNodeWithKey(config, privkey, pubkey)
+}
+
+// NewNodeWithKey creates a new node with an existing key pair,
+// e.g. one loaded from a keystore, so that the node keeps its
+// identity across sessions.
+func NewNodeWithKey(config Config, privkey []byte, pubkey []byte) (*Node, error) {
+	if len(privkey) != 32 || len(pubkey) != 32 {
+		return nil, fmt.Errorf("invalid key pair")
+	}
+
+	agreementPrivkey, agreementPubkey, err := x25519.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	config = config.withDefaults()
+	if config.SuccessorListSize < 0 {
+		return nil, fmt.Errorf("invalid successor list size %d", config.SuccessorListSize)
+	}
+
+	knownPeers := map[string][]byte{}
+	if config.KnownPeersPath != "" {
+		if knownPeers, err = loadKnownPeers(config.KnownPeersPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Node{
+		pubkey:           pubkey,
+		privkey:          privkey,
+		id:               IDFromPublicKey(pubkey),
+		config:           config,
+		agreementPubkey:  agreementPubkey,
+		agreementPrivkey: agreementPrivkey,
+		successors:       make([]remoteNode, config.SuccessorListSize),
+		fingers:          make([]remoteNode, fingerTableSize),
+		sessions:         map[string]*ratchet.Session{},
+		pendingChats:     map[string]ratchetKeyPair{},
+		chatLog:          []ChatEntry{},
+		chatKeys:         map[string]bool{},
+		store:            map[ID][]byte{},
+		knownPeers:       knownPeers,
+		conns:            map[*Peer]bool{},
+		peers:            map[string]*Peer{},
+		dials:            map[string]*dial{},
+		reachedAddrs:     map[string][]byte{},
+		chatMessages:     make(chan ChatEntry),
+		privateChats:     make(chan ChatEntry),
+		stabilizeCh:      make(chan struct{}),
+		closeCh:          make(chan struct{}),
+	}, nil
+}
+
+func (n *Node) Addr() string                   { return n.config.Addr }
+func (n *Node) ID() ID                         { return n.id }
+func (n *Node) PublicKey() []byte              { return n.pubkey }
+func (n *Node) PrivateKey() []byte             { return n.privkey }
+func (n *Node) AgreementPublicKey() []byte     { return n.agreementPubkey }
+func (n *Node) AgreementPrivateKey() []byte    { return n.agreementPrivkey }
+func (n *Node) ChatMessages() <-chan ChatEntry { return n.chatMessages }
+func (n *Node) PrivateChats() <-chan ChatEntry { return n.privateChats }
+func (n *Node) Config() Config                 { return n.config }
+
+// ChatLog returns the public chat messages known to the node.
+func (n *Node) ChatLog() []ChatEntry {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return append([]ChatEntry{}, n.chatLog...)
+}
+
+// ListenForConnections listens for peers.
+func (n *Node) ListenForConnections() error {
+	ln, err := n.config.Transport.Listen(n.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[info] listenting for peers on %s, advertised as %s", ln.Addr().String(), n.Addr())
+
+	n.mtx.Lock()
+	n.ln = ln
+	n.mtx.Unlock()
+
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		// log.Printf("[trace] peer connected at %s", conn.RemoteAddr().String())
+
+		// Perform the handshake in the background so that a slow or
+		// misbehaving peer cannot block the accept loop.
+		go func() {
+			peer := NewPeer(n, conn, false)
+			if err := n.performHandshake(peer, nil); err != nil {
+				// Peers checking the node's address disconnect
+				// on purpose once they have its handshake
+				if err != errHandshakeAborted {
+					log.Println("[error] handshake failed:", err)
+				}
+				peer.Close()
+				return
+			}
+
+			if err := n.verifyAddr(peer); err != nil {
+				log.Println("[error] rejected peer:", err)
+				peer.Close()
+				return
+			}
+
+			n.rememberPeer(peer)
+
+			if err := n.addPeer(peer); err != nil {
+				log.Println("[error] rejected peer:", err)
+				peer.Close()
+				return
+			}
+
+			n.handleMessages(peer)
+		}()
+	}
+}
+
+// Stabilize forces the node to run the periodic stabilize routine now.
+func (n *Node) Stabilize() error {
+	n.stabilizeCh <- struct{}{}
+	return n.runStabilize()
+}
+
+// runStabilize stabilizes the node and updates its successor list.
+// Runs never overlap, so that a run which is still waiting for a
+// failed successor doesn't race with the next one to replace it.
+func (n *Node) runStabilize() error {
+	n.stabilizeMtx.Lock()
+	defer n.stabilizeMtx.Unlock()
+
+	if err := n.stabilize(); err != nil {
+		return err
+	}
+
+	return n.updateSuccessorList()
+}
+
+// Chat broadcasts a public chat message to the network.
+func (n *Node) Chat(text string) error {
+	if n.Successor() == nil {
+		return fmt.Errorf("node has no successor")
+	}
+
+	chat, err := message.NewChat(n.privkey, n.pubkey, text)
+	if err != nil {
+		return err
+	}
+
+	if err := n.Successor().SendMessage(chat); err != nil {
+		return err
+	}
+
+	n.mtx.Lock()
+	n.addChatEntry(ChatEntry{
+		Text:      text,
+		PublicKey: n.pubkey,
+		Nonce:     chat.Nonce,
+		Signature: chat.Signature,
+	})
+	n.mtx.Unlock()
+
+	return nil
+}
+
+// StartPrivateChat initiates a private chat session with another peer.
+// This has to be done once for each pair of peers in the network.
+// The request is sent directly to the peer after looking it up, and
+// the peer responds over the same connection.
+func (n *Node) StartPrivateChat(publicKey []byte) error {
+	if n.Successor() == nil {
+		return fmt.Errorf("node has no successor")
+	}
+
+	peer, err := n.connectToRecipient(publicKey)
+	if err != nil {
+		return err
+	}
+
+	privkey, pubkey, err := x25519.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	n.mtx.Lock()
+	n.pendingChats[base64.StdEncoding.EncodeToString(publicKey)] = ratchetKeyPair{privkey, pubkey}
+	n.mtx.Unlock()
+
+	return peer.SendMessage(message.StartPrivateChatRequest{
+		PublicKey:  publicKey,
+		SenderKey:  n.pubkey,
+		RatchetKey: pubkey,
+		Sender:     n.Addr(),
+	})
+}
+
+// PrivateChat sends a private chat message.
+// The recipient is looked up using the finger table, and the message
+// is sent to it over a direct connection. The message is encrypted with the Double Ratchet
+// session shared with the recipient, so every message uses a fresh
+// key and other peers cannot read it.
+func (n *Node) PrivateChat(publicKey []byte, text string) error {
+	if n.Successor() == nil {
+		return fmt.Errorf("node has no successor")
+	}
+
+	session := n.session(publicKey)
+	if session == nil {
+		return fmt.Errorf("private chat has not been initialized with %s",
+			base64.StdEncoding.EncodeToString(publicKey))
+	}
+
+	msg := message.PrivateChat{
+		Sender:    n.pubkey,
+		PublicKey: publicKey,
+	}
+
+	var err error
+	msg.Header, msg.Ciphertext, err = session.Encrypt([]byte(text), msg.AssociatedData())
+	if err != nil {
+		return fmt.Errorf("failed to create private chat message: %s", err)
+	}
+
+	peer, err := n.connectToRecipient(publicKey)
+	if err != nil {
+		return err
+	}
+
+	return peer.SendMessage(msg)
+}
+
+// connectToRecipient looks up the peer with the public key
+// and connects to it directly.
+func (n *Node) connectToRecipient(publicKey []byte) (*Peer, error) {
+	addr, key, err := n.Lookup(IDFromPublicKey(publicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(key, publicKey) {
+		return nil, fmt.Errorf("recipient not found")
+	}
+
+	return n.connectToPeer(addr, publicKey)
+}
+
+func (n *Node) session(publicKey []byte) *ratchet.Session {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.sessions[base64.StdEncoding.EncodeToString(publicKey)]
+}
+
+func (n *Node) setSession(publicKey []byte, session *ratchet.Session) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.sessions[base64.StdEncoding.EncodeToString(publicKey)] = session
+}
+
+// acceptPrivateChat handles a StartPrivateChatRequest addressed to the node.
+// Unless the requester sent it directly, the node connects back to the
+// requester. It then derives the session's shared secret from the
+// connection's session key, and replies with its ratchet key.
+func (n *Node) acceptPrivateChat(peer *Peer, info message.StartPrivateChatRequest) error {
+	if !bytes.Equal(peer.PublicKey(), info.SenderKey) {
+		var err error
+		peer, err = n.connectToPeer(info.Sender, info.SenderKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !peer.Capabilities().Has(message.CapRatchet) {
+		return fmt.Errorf("peer does not support encrypted private chat")
+	}
+
+	secret, err := peer.ExportKey("p2p-chat private chat")
+	if err != nil {
+		return err
+	}
+
+	session, err := ratchet.NewInitiatorSession(secret, info.RatchetKey)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.SendMessage(message.StartPrivateChatResponse{
+		RatchetKey: session.PublicKey(),
+	}); err != nil {
+		return err
+	}
+
+	n.setSession(peer.PublicKey(), session)
+
+	log.Println("[info] initialized private message with",
+		base64.StdEncoding.EncodeToString(peer.PublicKey()))
+
+	return nil
+}
+
+// completePrivateChat handles the StartPrivateChatResponse sent by the
+// recipient of a private chat request over a direct connection.
+func (n *Node) completePrivateChat(peer *Peer, response message.StartPrivateChatResponse) error {
+	key := base64.StdEncoding.EncodeToString(peer.PublicKey())
+
+	n.mtx.Lock()
+	keyPair, ok := n.pendingChats[key]
+	delete(n.pendingChats, key)
+	n.mtx.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unsolicited private chat response from %s", key)
+	}
+
+	secret, err := peer.ExportKey("p2p-chat private chat")
+	if err != nil {
+		return err
+	}
+
+	session, err := ratchet.NewResponderSession(secret, keyPair.privkey, keyPair.pubkey, response.RatchetKey)
+	if err != nil {
+		return err
+	}
+
+	n.setSession(peer.PublicKey(), session)
+
+	log.Println("[info] initialized private message with", key)
+
+	return nil
+}
+
+func (n *Node) Close() {
+	log.Println("[info] shutting down node")
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	select {
+	case <-n.closeCh:
+		return
+	default:
+	}
+
+	close(n.closeCh)
+
+	if n.ln != nil {
+		n.ln.Close()
+	}
+}
+
+// Leave leaves the ring gracefully. The node hands over its values
+// to its successor, then sends Leave to its predecessor and successor
+// so that they splice it out of the ring right away, instead of
+// noticing its absence when stabilizing. The node must be closed
+// afterwards.
+func (n *Node) Leave() error {
+	successor := n.Successor()
+	if successor == nil {
+		return nil
+	}
+
+	n.mtx.Lock()
+	values := map[ID][]byte{}
+	for id, value := range n.store {
+		values[id] = value
+	}
+
+	msg := message.Leave{
+		Predecessor:    n.predecessor,
+		PredecessorKey: n.predecessorKey,
+		Successor:      successor.ListenAddr(),
+		SuccessorKey:   successor.PublicKey(),
+		Successors:     []message.SuccessorEntry{},
+	}
+	for _, s := range n.successors {
+		if s.addr != "" {
+			msg.Successors = append(msg.Successors, message.SuccessorEntry{PublicKey: s.key, Addr: s.addr})
+		}
+	}
+	predecessor := n.predecessorPeer
+	n.mtx.Unlock()
+
+	// The predecessor may not have notified the node over
+	// its own connection yet, e.g. after a peer has left.
+	if predecessor == nil && msg.Predecessor != "" {
+		if peer, err := n.connectToPeer(msg.Predecessor, msg.PredecessorKey); err == nil {
+			predecessor = peer
+		}
+	}
+
+	// The successor takes over the values, and replicates them
+	// to make up for the leaving node.
+	for id, value := range values {
+		err := successor.SendMessage(message.Replicate{
+			Count: n.config.SuccessorListSize - 1,
+			Key:   id[:],
+			Value: value,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := successor.SendMessage(msg); err != nil {
+		return err
+	}
+
+	if predecessor != nil && predecessor != successor {
+		if err := predecessor.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleLeave splices a leaving peer out of the ring. If it's the
+// node's successor, its successor becomes the node's successor. If
+// it's the node's predecessor, its predecessor becomes the node's
+// predecessor. A peer in a ring of two nodes is both.
+func (n *Node) handleLeave(peer *Peer, msg message.Leave) error {
+	n.removeFinger(peer.PublicKey())
+
+	n.mtx.Lock()
+	if bytes.Equal(peer.PublicKey(), n.predecessorKey) {
+		if bytes.Equal(msg.PredecessorKey, n.pubkey) || msg.Predecessor == "" {
+			n.predecessor = ""
+			n.predecessorKey = nil
+		} else {
+			n.predecessor = msg.Predecessor
+			n.predecessorKey = msg.PredecessorKey
+		}
+
+		// The new predecessor may have notified the node already,
+		// which was rejected, since it's not between the leaving
+		// peer and the node, so use any open connection to it
+		n.predecessorPeer = n.peers[string(n.predecessorKey)]
+	}
+
+	successor := n.successor
+	n.mtx.Unlock()
+
+	if successor == nil || !bytes.Equal(peer.PublicKey(), successor.PublicKey()) {
+		return nil
+	}
+
+	if bytes.Equal(msg.SuccessorKey, n.pubkey) {
+		// The node is now alone
+		n.mtx.Lock()
+		n.successor = nil
+		for i := range n.successors {
+			n.successors[i] = remoteNode{}
+		}
+		n.mtx.Unlock()
+
+		successor.Close()
+		return nil
+	}
+
+	if err := n.setSuccessor(msg.Successor, msg.SuccessorKey); err != nil {
+		return err
+	}
+
+	n.setSuccessorList(msg.Successors)
+	return nil
+}
+
+// JoinPeer makes the node join the peer network through the peer
+// at the specified address. The node looks up the successor of its
+// ID, and inserts itself in the ring right before it.
+func (n *Node) JoinPeer(address string) error {
+	successor, successorKey, err := n.findSuccessor(address, nil, n.id)
+	if err != nil {
+		return err
+	}
+
+	return n.setSuccessor(successor, successorKey)
+}
+
+// Lookup returns the address and public key of the successor of the
+// ID, i.e. the node responsible for it. The lookup starts from the
+// finger which most closely precedes the ID, so it takes O(log N) hops.
+func (n *Node) Lookup(id ID) (string, []byte, error) {
+	successor := n.Successor()
+	if successor == nil {
+		// The node is alone, so it's the successor of every ID
+		return n.Addr(), n.pubkey, nil
+	}
+
+	if id.BetweenRightInclusive(n.id, IDFromPublicKey(successor.PublicKey())) {
+		return successor.ListenAddr(), successor.PublicKey(), nil
+	}
+
+	if f, ok := n.closestPrecedingFinger(id); ok {
+		addr, key, err := n.findSuccessor(f.addr, f.key, id)
+		if err == nil {
+			return addr, key, nil
+		}
+
+		// The finger is stale, so fall back to the successor
+		log.Printf("[warn] lookup through finger %s failed: %s", f.addr, err)
+		n.removeFinger(f.key)
+	}
+
+	return n.findSuccessor(successor.ListenAddr(), successor.PublicKey(), id)
+}
+
+// findSuccessor looks up the successor of the ID, starting from the
+// peer at the specified address, which must identify itself with key
+// if it's not nil.
+func (n *Node) findSuccessor(address string, key []byte, id ID) (string, []byte, error) {
+	var previous string
+	var previousKey []byte
+	avoidFingers := false
+
+	for hops := 0; hops < maxLookupHops; hops++ {
+		response, err := n.askSuccessor(address, key, id, avoidFingers)
+		if err != nil {
+			if previous == "" {
+				return "", nil, err
+			}
+
+			// The peer may have left the ring without the previous peer
+			// noticing yet, so go back and route through its successor,
+			// which is repaired right away.
+			address, key, previous = previous, previousKey, ""
+			avoidFingers = true
+			continue
+		}
+
+		if response.Found {
+			return response.Addr, response.PublicKey, nil
+		}
+
+		if response.Addr == address || response.Addr == n.Addr() {
+			return "", nil, fmt.Errorf("lookup for %s is looping at %s", id, address)
+		}
+
+		previous, previousKey = address, key
+		address, key = response.Addr, response.PublicKey
+		avoidFingers = false
+	}
+
+	return "", nil, fmt.Errorf("lookup for %s exceeded %d hops", id, maxLookupHops)
+}
+
+// askSuccessor asks the peer at the specified address for the
+// successor of the ID.
+func (n *Node) askSuccessor(address string, expectedKey []byte, id ID, avoidFingers bool) (message.FindSuccessorResponse, error) {
+	peer, err := n.connectToPeer(address, expectedKey)
+	if err != nil {
+		return message.FindSuccessorResponse{}, err
+	}
+
+	request := message.FindSuccessorRequest{ID: id[:], AvoidFingers: avoidFingers}
+	response, err := n.request(peer, request, message.OpcodeFindSuccessorResponse, n.config.RequestTimeout)
+	if err != nil {
+		return message.FindSuccessorResponse{}, fmt.Errorf("lookup at %s failed: %s", address, err)
+	}
+
+	return response.(message.FindSuccessorResponse), nil
+}
+
+// handleFindSuccessor answers a FindSuccessorRequest: if the ID is
+// between the node and its successor, the successor is the answer.
+// Otherwise, the lookup must continue at the closest preceding finger,
+// or at the successor if the requester avoids fingers.
+func (n *Node) handleFindSuccessor(peer *Peer, requestID uint32, msg message.FindSuccessorRequest) error {
+	id := IDFromBytes(msg.ID)
+
+	successor := n.Successor()
+	if successor == nil {
+		// The node is alone, so it's the successor of every ID
+		return peer.Respond(requestID, message.FindSuccessorResponse{
+			Found:     true,
+			PublicKey: n.pubkey,
+			Addr:      n.Addr(),
+		})
+	}
+
+	if id.BetweenRightInclusive(n.id, IDFromPublicKey(successor.PublicKey())) {
+		return peer.Respond(requestID, message.FindSuccessorResponse{
+			Found:     true,
+			PublicKey: successor.PublicKey(),
+			Addr:      successor.ListenAddr(),
+		})
+	}
+
+	if f, ok := n.closestPrecedingFinger(id); ok && !msg.AvoidFingers {
+		return peer.Respond(requestID, message.FindSuccessorResponse{
+			PublicKey: f.key,
+			Addr:      f.addr,
+		})
+	}
+
+	return peer.Respond(requestID, message.FindSuccessorResponse{
+		PublicKey: successor.PublicKey(),
+		Addr:      successor.ListenAddr(),
+	})
+}
+
+// setSuccessor connects to the peer at the specified address, which
+// must identify itself with expectedKey if it's not nil, and makes it
+// the node's successor.
+func (n *Node) setSuccessor(address string, expectedKey []byte) error {
+	peer, err := n.connectToPeer(address, expectedKey)
+	if err != nil {
+		return err
+	}
+
+	if err := n.notify(peer); err != nil {
+		return err
+	}
+
+	// Exchange chat logs with the peer, so that a joining node gets the
+	// chat log, and so that the chat logs of rings which have diverged,
+	// e.g. during a partition, are reconciled. A failed exchange doesn't
+	// keep the peer from becoming the successor, since the logs are
+	// reconciled again by later merges.
+	if err := n.sendChatLog(peer); err != nil {
+		log.Printf("[warn] send chat log to %s failed: %s", peer.ListenAddr(), err)
+	}
+
+	if err := peer.SendMessage(message.ChatLogRequest{}); err != nil {
+		log.Printf("[warn] request chat log from %s failed: %s", peer.ListenAddr(), err)
+	}
+
+	n.mtx.Lock()
+	previous := n.successor
+	n.successor = peer
+	n.mtx.Unlock()
+
+	// Start the maintenance routines once the node has
+	// joined a ring, i.e. when it gets its first successor
+	n.maintainOnce.Do(func() {
+		go n.handleStabilize()
+		go n.handleFixFingers()
+		go n.handleCheckPredecessor()
+		go n.handleProbe()
+		go n.handleEvictIdle()
+	})
+
+	// The connection to the previous successor is kept open, since
+	// it may still be used, e.g. if the previous successor is also the
+	// node's predecessor. It's closed once idle.
+	if previous != nil && !bytes.Equal(previous.PublicKey(), peer.PublicKey()) {
+		go n.replicateOwned()
+	}
+
+	return nil
+}
+
+// performHandshake performs the cryptographic handshake with the peer.
+// Both sides first exchange challenge nonces along with their protocol
+// version and capabilities, so that incompatible peers are refused, then
+// a signed handshake which includes the other side's nonce, so that a
+// recorded handshake cannot be replayed. If expectedKey is not nil, the
+// peer must identify itself with that public key.
+func (n *Node) performHandshake(peer *Peer, expectedKey []byte) error {
+	timeout := n.config.Clock.After(n.config.HandshakeTimeout)
+
+	challenge, err := message.NewHandshakeChallenge(SupportedCapabilities)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.SendMessage(challenge); err != nil {
+		return err
+	}
+
+	msg, err := receiveHandshakeMessage(peer, timeout)
+	if err != nil {
+		return err
+	}
+
+	remoteChallenge, ok := msg.(message.HandshakeChallenge)
+	if !ok {
+		return fmt.Errorf("peer did not send a handshake challenge")
+	}
+
+	capabilities, err := remoteChallenge.Negotiate(SupportedCapabilities, RequiredCapabilities)
+	if err != nil {
+		return err
+	}
+
+	// Generate a fresh ephemeral key for every connection, so that
+	// each connection gets its own session key.
+	ephemeralPrivkey, ephemeralPubkey, err := x25519.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	request, err := message.NewHandshake(n.privkey, n.pubkey, n.agreementPubkey,
+		ephemeralPubkey, remoteChallenge.Nonce, n.Addr())
+	if err != nil {
+		return err
+	}
+
+	if err := peer.SendMessage(request); err != nil {
+		return err
+	}
+
+	if msg, err = receiveHandshakeMessage(peer, timeout); err != nil {
+		return err
+	}
+
+	handshake, ok := msg.(message.Handshake)
+	if !ok {
+		return fmt.Errorf("peer did not send a handshake")
+	}
+
+	if err := handshake.Verify(); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(handshake.Challenge, challenge.Nonce) {
+		return fmt.Errorf("handshake does not answer our challenge")
+	}
+
+	// Reject addresses the peer obviously can't be reached at
+	// right away, before connecting back to check the others
+	if err := n.config.Transport.CheckAddr(handshake.Addr, peer.conn.RemoteAddr()); err != nil {
+		return fmt.Errorf("peer advertised an invalid address: %s", err)
+	}
+
+	if expectedKey != nil && !bytes.Equal(handshake.PublicKey, expectedKey) {
+		return fmt.Errorf("peer identified itself as %s, expected %s",
+			base64.StdEncoding.EncodeToString(handshake.PublicKey),
+			base64.StdEncoding.EncodeToString(expectedKey))
+	}
+
+	transcript := HandshakeTranscript{
+		LocalChallenge:  challenge,
+		RemoteChallenge: remoteChallenge,
+		Local:           request,
+		Remote:          handshake,
+	}
+
+	if err := peer.PerformHandshake(transcript, ephemeralPrivkey, capabilities); err != nil {
+		return err
+	}
+
+	// log.Printf("[trace] cryptographic handshake with peer %s successful", peer.Addr())
+	return nil
+}
+
+// receiveHandshakeMessage waits for the next message of the handshake.
+func receiveHandshakeMessage(peer *Peer, timeout <-chan time.Time) (message.Message, error) {
+	select {
+	case envelope := <-peer.Incoming():
+		return envelope.Message, nil
+	case <-peer.closeCh:
+		return nil, errHandshakeAborted
+	case <-timeout:
+		return nil, fmt.Errorf("handshake timed out")
+	}
+}
+
+func (n *Node) handleMessages(peer *Peer) {
+	for {
+		select {
+		case envelope := <-peer.Incoming():
+			n.handleMessage(peer, envelope)
+
+		case <-peer.closeCh:
+			n.removePeer(peer)
+			n.forgetPredecessor(peer)
+			return
+		}
+	}
+}
+
+// handleMessage dispatches a message received from the peer. The
+// answer to a request must be sent with its request ID.
+func (n *Node) handleMessage(peer *Peer, envelope message.Envelope) {
+	switch msg := envelope.Message.(type) {
+	case message.Chat:
+		// Drop chat messages which are not signed by their
+		// claimed author, so that they are neither displayed
+		// nor relayed any further.
+		if err := msg.Verify(); err != nil {
+			log.Printf("[warn] rejected chat message claiming to be from %s relayed by %s: %s",
+				base64.StdEncoding.EncodeToString(msg.PublicKey), peer.ListenAddr(), err)
+			return
+		}
+
+		entry := ChatEntry{
+			Text:      msg.Text,
+			PublicKey: msg.PublicKey,
+			Nonce:     msg.Nonce,
+			Signature: msg.Signature,
+		}
+
+		// Drop chat messages the node already has, e.g. received
+		// through a chat log, so that they are neither stored twice
+		// nor relayed around the ring forever
+		n.mtx.Lock()
+		added := n.addChatEntry(entry)
+		n.mtx.Unlock()
+
+		if !added {
+			return
+		}
+
+		n.chatMessages <- entry
+
+		// If the node's successor is not the sender of the chat message,
+		// propagate the chat message to the successor, effectively
+		// broadcasting the chat message.
+		if n.Successor() != nil && !bytes.Equal(msg.PublicKey, n.Successor().PublicKey()) {
+			if err := n.Successor().SendMessage(msg); err != nil {
+				log.Println("[error] propagate chat failed:", err)
+			}
+		}
+
+	case message.ChatLogRequest:
+		if err := n.sendChatLog(peer); err != nil {
+			log.Println("[error] chat log response failed:", err)
+		}
+
+	case message.ChatLog:
+		n.mergeChatLog(peer, msg)
+
+	case message.Notify:
+		n.rectify(peer, msg)
+
+	case message.StabilizeRequest:
+		// The response is sent after unlocking, so that a stalled
+		// peer doesn't block the node
+		n.mtx.Lock()
+		response := message.StabilizeResponse{
+			Predecessor: n.predecessor,
+			PublicKey:   n.predecessorKey,
+		}
+		n.mtx.Unlock()
+
+		if err := peer.Respond(envelope.RequestID, response); err != nil {
+			log.Println("[error] stabilize response failed:", err)
+		}
+
+	case message.StartPrivateChatRequest:
+		// Private chats are sent straight to their recipient, so
+		// messages addressed to another node are not relayed
+		if !bytes.Equal(msg.PublicKey, n.pubkey) {
+			log.Printf("[warn] dropped private chat request for %s from %s",
+				base64.StdEncoding.EncodeToString(msg.PublicKey), peer.ListenAddr())
+			return
+		}
+
+		if err := n.acceptPrivateChat(peer, msg); err != nil {
+			log.Println("[error] failed to start private chat:", err)
+		}
+
+	case message.StartPrivateChatResponse:
+		if err := n.completePrivateChat(peer, msg); err != nil {
+			log.Println("[error] failed to start private chat:", err)
+		}
+
+	case message.PrivateChat:
+		if !bytes.Equal(msg.PublicKey, n.pubkey) {
+			log.Printf("[warn] dropped private chat message for %s from %s",
+				base64.StdEncoding.EncodeToString(msg.PublicKey), peer.ListenAddr())
+			return
+		}
+
+		session := n.session(msg.Sender)
+		if session == nil {
+			log.Println("[error] private chat session not found for peer", base64.StdEncoding.EncodeToString(msg.Sender))
+			return
+		}
+
+		text, err := session.Decrypt(msg.Header, msg.Ciphertext, msg.AssociatedData())
+		if err != nil {
+			log.Println("[error] decrypt private chat failed:", err)
+			return
+		}
+
+		n.privateChats <- ChatEntry{
+			Text:      string(text),
+			PublicKey: msg.Sender,
+		}
+
+	case message.SuccessorRequest:
+		if err := n.handleSuccessorRequest(peer, envelope.RequestID, msg); err != nil {
+			log.Println("[error] send successor list failed:", err)
+		}
+
+	case message.Ping:
+		if err := peer.Respond(envelope.RequestID, message.Pong{}); err != nil {
+			log.Println("[error] ping failed:", err)
+		}
+
+	case message.FindSuccessorRequest:
+		if err := n.handleFindSuccessor(peer, envelope.RequestID, msg); err != nil {
+			log.Println("[error] find successor failed:", err)
+		}
+
+	case message.StoreRequest:
+		if err := n.handleStoreRequest(peer, envelope.RequestID, msg); err != nil {
+			log.Println("[error] store failed:", err)
+		}
+
+	case message.Replicate:
+		if err := n.handleReplicate(msg); err != nil {
+			log.Println("[error] replicate failed:", err)
+		}
+
+	case message.FetchRequest:
+		if err := n.handleFetchRequest(peer, envelope.RequestID, msg); err != nil {
+			log.Println("[error] fetch failed:", err)
+		}
+
+	case message.Leave:
+		if err := n.handleLeave(peer, msg); err != nil {
+			log.Println("[error] splicing leaving peer failed:", err)
+		}
+
+	case message.Merge:
+		// Merging looks up the node's successor in the other ring,
+		// possibly over this very connection, so it must not hold
+		// up the messages received from the peer
+		go func() {
+			if err := n.merge(msg); err != nil {
+				log.Println("[error] merge failed:", err)
+			}
+		}()
+	}
+}
+
+func (n *Node) notify(peer *Peer) error {
+	return peer.SendMessage(message.Notify{
+		Predecessor: n.Addr(),
+	})
+}
+
+// rectify handles a Notify from a peer which thinks it might be the
+// node's predecessor. The peer becomes the predecessor if the node has
+// none, or if the peer is between the current predecessor and the node.
+// A notify from the current predecessor refreshes the connection it's
+// known by, since the previous one may be closed.
+func (n *Node) rectify(peer *Peer, msg message.Notify) {
+	candidate := IDFromPublicKey(peer.PublicKey())
+
+	n.mtx.Lock()
+	changed := false
+	if n.predecessor == "" || bytes.Equal(peer.PublicKey(), n.predecessorKey) ||
+		candidate.Between(IDFromPublicKey(n.predecessorKey), n.id) {
+		// log.Printf("[trace] updating predecessor to %s", peer.ListenAddr())
+		changed = !bytes.Equal(peer.PublicKey(), n.predecessorKey)
+		n.predecessor = peer.ListenAddr()
+		n.predecessorKey = peer.PublicKey()
+		n.predecessorPeer = peer
+	}
+	n.mtx.Unlock()
+
+	// Hand off the values the new predecessor is responsible for
+	if changed {
+		go n.handoff(peer)
+	}
+
+	// If a node has no successor, it means the node
+	// is the initial node. If so, set the peer as its
+	// successor and start the stabilization goroutine.
+	if n.Successor() == nil {
+		// log.Printf("[trace] updating successor to %s", peer.ListenAddr())
+		if err := n.setSuccessor(peer.ListenAddr(), peer.PublicKey()); err != nil {
+			log.Println("[error]", err)
+		}
+	}
+}
+
+func (n *Node) handleStabilize() {
+	for {
+		select {
+		case <-n.config.Clock.After(n.config.StabilizeInterval):
+			if n.Successor() == nil {
+				// The node is alone, e.g. after every other node has left
+				continue
+			}
+
+			// The next run is only scheduled once this one is done
+			if err := n.runStabilize(); err != nil {
+				log.Println("[error] stabilization failed:", err)
+			}
+
+		case <-n.stabilizeCh:
+
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+func (n *Node) handleCheckPredecessor() {
+	for {
+		select {
+		case <-n.config.Clock.After(n.config.CheckPredecessorInterval):
+			go func() {
+				if err := n.checkPredecessor(); err != nil {
+					log.Println("[warn] predecessor failed:", err)
+				}
+			}()
+
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+// checkPredecessor pings the node's predecessor, and forgets it if
+// it doesn't answer in time, so that a crashed predecessor is neither
+// kept forever nor returned to the node's predecessor in a
+// StabilizeResponse. Otherwise, the node would reject the Notify of
+// its new predecessor, which is not between the crashed one and the
+// node.
+func (n *Node) checkPredecessor() error {
+	n.mtx.Lock()
+	address, key, peer := n.predecessor, n.predecessorKey, n.predecessorPeer
+	n.mtx.Unlock()
+
+	if address == "" {
+		return nil
+	}
+
+	// The predecessor may not have notified the node over
+	// its own connection yet, e.g. after a peer has left.
+	if peer == nil {
+		var err error
+		peer, err = n.connectToPeer(address, key)
+		if err != nil {
+			n.clearPredecessor(key)
+			return err
+		}
+	}
+
+	if _, err := n.request(peer, message.Ping{}, message.OpcodePong, n.config.PingTimeout); err != nil {
+		n.clearPredecessor(key)
+		return fmt.Errorf("predecessor %s did not answer ping: %s", address, err)
+	}
+
+	return nil
+}
+
+// clearPredecessor forgets the node's predecessor if it's still
+// the peer with the public key.
+func (n *Node) clearPredecessor(key []byte) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if !bytes.Equal(n.predecessorKey, key) {
+		return
+	}
+
+	n.predecessor = ""
+	n.predecessorKey = nil
+	n.predecessorPeer = nil
+}
+
+// forgetPredecessor forgets the node's predecessor if it notified the
+// node over the connection, which has been closed. The predecessor will
+// notify the node again over a new connection if it's still alive.
+func (n *Node) forgetPredecessor(peer *Peer) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.predecessorPeer != peer {
+		return
+	}
+
+	n.predecessor = ""
+	n.predecessorKey = nil
+	n.predecessorPeer = nil
+}
+
+// Predecessor returns the address of the node's predecessor,
+// or an empty string if it's unknown.
+func (n *Node) Predecessor() string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.predecessor
+}
+
+func (n *Node) Successor() *Peer {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.successor
+}
+
+// SuccessorList returns the addresses in the node's successor list,
+// i.e. the nodes which follow its successor along the ring.
+func (n *Node) SuccessorList() []string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	successors := []string{}
+	for _, s := range n.successors {
+		if s.addr != "" {
+			successors = append(successors, s.addr)
+		}
+	}
+
+	return successors
+}
+
+func (n *Node) stabilize() error {
+	successor := n.Successor()
+	if successor == nil {
+		return fmt.Errorf("node has no successor")
+	}
+
+	if _, err := n.request(successor, message.Ping{}, message.OpcodePong, n.config.PingTimeout); err != nil {
+		return n.findNextSuccessor(successor)
+	}
+
+	// log.Printf("[trace] running periodic stabilize routine (successor=%s, predecessor=%s)",
+	// 	n.Successor().ListenAddr(), n.predecessor)
+
+	msg, err := n.request(successor, message.StabilizeRequest{}, message.OpcodeStabilizeResponse, n.config.RequestTimeout)
+	if err != nil {
+		return err
+	}
+	response := msg.(message.StabilizeResponse)
+
+	// If the successor's predecessor is between the node and its
+	// successor, it has joined in the meantime and becomes the new
+	// successor.
+	if response.Predecessor != "" {
+		predecessor := IDFromPublicKey(response.PublicKey)
+		if predecessor.Between(n.id, IDFromPublicKey(successor.PublicKey())) {
+			// log.Printf("[trace] updating successor to %s", response.Predecessor)
+			return n.setSuccessor(response.Predecessor, response.PublicKey)
+		}
+	}
+
+	if response.Predecessor == n.Addr() {
+		return nil
+	}
+
+	return n.notify(successor)
+}
+
+// updateSuccessorList asks the node's successor for its successor
+// list, which, preceded by the successor itself, becomes the node's
+// successor list.
+func (n *Node) updateSuccessorList() error {
+	successor := n.Successor()
+	if successor == nil {
+		return fmt.Errorf("node has no successor")
+	}
+
+	n.mtx.Lock()
+	count := len(n.successors)
+	n.mtx.Unlock()
+
+	msg, err := n.request(successor, message.SuccessorRequest{Count: count}, message.OpcodeSuccessorResponse, n.config.RequestTimeout)
+	if err != nil {
+		return err
+	}
+
+	n.setSuccessorList(msg.(message.SuccessorResponse).Successors)
+	return nil
+}
+
+// handleSuccessorRequest answers a SuccessorRequest with the node's
+// successor followed by its successor list.
+func (n *Node) handleSuccessorRequest(peer *Peer, requestID uint32, msg message.SuccessorRequest) error {
+	n.mtx.Lock()
+	successors := []message.SuccessorEntry{}
+	if n.successor != nil {
+		successors = append(successors, message.SuccessorEntry{
+			PublicKey: n.successor.PublicKey(),
+			Addr:      n.successor.ListenAddr(),
+		})
+
+		for _, s := range n.successors {
+			if s.addr != "" {
+				successors = append(successors, message.SuccessorEntry{PublicKey: s.key, Addr: s.addr})
+			}
+		}
+	}
+	n.mtx.Unlock()
+
+	if msg.Count >= 0 && len(successors) > msg.Count {
+		successors = successors[:msg.Count]
+	}
+
+	return peer.Respond(requestID, message.SuccessorResponse{Successors: successors})
+}
+
+// setSuccessorList replaces the node's successor list. The list is cut
+// short at the node itself, which appears in it if the ring has fewer
+// nodes than the list.
+func (n *Node) setSuccessorList(successors []message.SuccessorEntry) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for i := range n.successors {
+		n.successors[i] = remoteNode{}
+	}
+
+	for i, s := range successors {
+		if i >= len(n.successors) || bytes.Equal(s.PublicKey, n.pubkey) {
+			break
+		}
+
+		n.successors[i] = remoteNode{addr: s.Addr, key: s.PublicKey, id: IDFromPublicKey(s.PublicKey)}
+	}
+}
+
+// findNextSuccessor replaces the failed successor with the first
+// reachable node of the successor list.
+func (n *Node) findNextSuccessor(failed *Peer) error {
+	log.Printf("[warn] unable to contact peer %s, finding new successor from successor list", failed.ListenAddr())
+	failed.Close()
+
+	// The successor has been replaced in the meantime,
+	// e.g. because the failed peer has left the ring
+	if n.Successor() != failed {
+		return nil
+	}
+
+	n.mtx.Lock()
+	successors := make([]remoteNode, len(n.successors))
+	copy(successors, n.successors)
+	n.mtx.Unlock()
+
+	found := false
+	for i, s := range successors {
+		if s.addr == "" {
+			continue
+		}
+
+		if err := n.setSuccessor(s.addr, s.key); err == nil {
+			// Found new successor. The entries before it are
+			// unreachable, so they are pruned from the list.
+			found = true
+			log.Println("[info] found new successor:", s.addr)
+
+			n.mtx.Lock()
+			for j := range n.successors {
+				n.successors[j] = remoteNode{}
+				if i+1+j < len(successors) {
+					n.successors[j] = successors[i+1+j]
+				}
+			}
+			n.mtx.Unlock()
+			break
+		}
+	}
+
+	// If the whole successor list is unreachable, e.g. because of a
+	// partition, fall back to the closest peer the node has seen.
+	// Stabilization then moves the successor closer if needed.
+	if !found {
+		for _, p := range n.closestKnownPeers() {
+			if err := n.setSuccessor(p.addr, p.key); err == nil {
+				found = true
+				log.Println("[info] found new successor among known peers:", p.addr)
+				break
+			}
+		}
+	}
+
+	// The node is cut off from the ring, so it's alone
+	// until it manages to rejoin
+	if !found {
+		n.mtx.Lock()
+		n.successor = nil
+		for i := range n.successors {
+			n.successors[i] = remoteNode{}
+		}
+		n.mtx.Unlock()
+
+		n.startRejoin()
+		return fmt.Errorf("failed to find successor")
+	}
+
+	return nil
+}
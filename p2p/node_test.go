@@ -0,0 +1,366 @@
+package p2p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"github.com/hasyimibhar/p2p-chat/message"
+	"github.com/hasyimibhar/p2p-chat/transport"
+)
+
+func TestNode_Pair(t *testing.T) {
+	network := transport.NewMemory()
+
+	node1, err := NewNode(Config{Addr: "node1", Transport: network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node1.ListenForConnections()
+	defer node1.Close()
+
+	node2, err := NewNode(Config{Addr: "node2", Transport: network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node2.ListenForConnections()
+	defer node2.Close()
+
+	waitForListener(t, network, node1.Addr())
+	waitForListener(t, network, node2.Addr())
+
+	err = node2.JoinPeer(node1.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Force node1 to stabilize to form the ring
+	err = node1.Stabilize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.Chat("Hello, world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-node2.ChatMessages()
+	if msg.Text != "Hello, world" {
+		t.Fatal("incorrect message received")
+	}
+
+	err = node2.Chat("lorem ipsum dolor sit amet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg = <-node1.ChatMessages()
+	if msg.Text != "lorem ipsum dolor sit amet" {
+		t.Fatal("incorrect message received")
+	}
+}
+
+func TestNewNodeWithKey(t *testing.T) {
+	node1, err := NewNode(Config{Addr: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node2, err := NewNodeWithKey(Config{Addr: "node2"}, node1.PrivateKey(), node1.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(node1.PublicKey(), node2.PublicKey()) {
+		t.Fatal("node did not keep its identity")
+	}
+
+	if _, err := NewNodeWithKey(Config{Addr: "node3"}, nil, nil); err == nil {
+		t.Fatal("expected error for invalid key pair")
+	}
+}
+
+func TestNode_KnownPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	network := transport.NewMemory()
+	path := filepath.Join(dir, "peers.json")
+
+	node1, err := NewNode(Config{Addr: "node1", Transport: network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node1.ListenForConnections()
+	defer node1.Close()
+
+	node2, err := NewNode(Config{Addr: "node2", Transport: network, KnownPeersPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node2.ListenForConnections()
+	waitForListener(t, network, node1.Addr())
+	waitForListener(t, network, node2.Addr())
+
+	if err := node2.JoinPeer(node1.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50 && node1.Successor() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Leave, so that node1 doesn't consider the node its member anymore
+	if err := node2.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	node2.Close()
+
+	for i := 0; i < 50 && node1.Successor() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// After a restart, the node rejoins through the peers it has seen
+	node3, err := NewNodeWithKey(Config{Addr: "node3", Transport: network, KnownPeersPath: path},
+		node2.PrivateKey(), node2.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node3.ListenForConnections()
+	defer node3.Close()
+	waitForListener(t, network, node3.Addr())
+
+	if err := node3.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if node3.Successor() == nil || node3.Successor().ListenAddr() != node1.Addr() {
+		t.Fatal("node did not rejoin through a known peer")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewNode(Config{Addr: "node4", KnownPeersPath: path}); err == nil {
+		t.Fatal("expected error for invalid known peers file")
+	}
+}
+
+// waitForListener blocks until the address accepts connections.
+func waitForListener(t *testing.T, network transport.Transport, addr string) {
+	for i := 0; i < 50; i++ {
+		conn, err := network.Dial(addr, 0)
+		if err == nil {
+			conn.Close()
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("%s is not accepting connections", addr)
+}
+
+func TestNode_RejectSpoofedChat(t *testing.T) {
+	network := transport.NewMemory()
+
+	node1, err := NewNode(Config{Addr: "node1", Transport: network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node1.ListenForConnections()
+	defer node1.Close()
+
+	node2, err := NewNode(Config{Addr: "node2", Transport: network})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node2.ListenForConnections()
+	defer node2.Close()
+
+	waitForListener(t, network, node1.Addr())
+	waitForListener(t, network, node2.Addr())
+
+	if err := node2.JoinPeer(node1.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Claim to be node1 without a valid signature
+	spoofed := message.Chat{
+		PublicKey: node1.PublicKey(),
+		Nonce:     make([]byte, message.ChatNonceSize),
+		Text:      "spoofed",
+		Signature: make([]byte, 64),
+	}
+	if err := node2.Successor().SendMessage(spoofed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node2.Chat("genuine"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-node1.ChatMessages()
+	if msg.Text != "genuine" {
+		t.Fatal("spoofed message was accepted")
+	}
+}
+
+func TestNode_MergeChatLogKeepsIdenticalMessages(t *testing.T) {
+	node, err := NewNode(Config{Addr: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, pub, _ := ed25519.GenerateKey()
+	chat1, _ := message.NewChat(priv, pub, "lorem ipsum")
+	chat2, _ := message.NewChat(priv, pub, "lorem ipsum")
+
+	chatLog := message.ChatLog{Entries: []message.Chat{chat1, chat2}}
+	node.mergeChatLog(nil, chatLog)
+
+	if n := len(node.ChatLog()); n != 2 {
+		t.Fatalf("expected 2 entries, got %d", n)
+	}
+
+	// Entries which are already known are skipped
+	node.mergeChatLog(nil, chatLog)
+
+	if n := len(node.ChatLog()); n != 2 {
+		t.Fatalf("expected 2 entries, got %d", n)
+	}
+}
+
+func TestNode_DropKnownChat(t *testing.T) {
+	node, err := NewNode(Config{Addr: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, pub, _ := ed25519.GenerateKey()
+	chat, _ := message.NewChat(priv, pub, "lorem ipsum")
+
+	// The message reaches the node through a chat log first
+	node.mergeChatLog(nil, message.ChatLog{Entries: []message.Chat{chat}})
+
+	done := make(chan struct{})
+	go func() {
+		node.handleMessage(nil, message.Envelope{Message: chat})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-node.ChatMessages():
+		t.Fatal("known message was displayed again")
+	case <-time.After(time.Second):
+		t.Fatal("known message was not dropped")
+	}
+
+	if n := len(node.ChatLog()); n != 1 {
+		t.Fatalf("expected 1 entry, got %d", n)
+	}
+}
+
+func TestNode_ChatLogIsSplitIntoFrames(t *testing.T) {
+	node, err := NewNode(Config{Addr: "node1", MaxFrameSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, pub, _ := ed25519.GenerateKey()
+	for i := 0; i < 50; i++ {
+		chat, _ := message.NewChat(priv, pub, "lorem ipsum dolor sit amet")
+		node.chatLog = append(node.chatLog, ChatEntry{
+			PublicKey: chat.PublicKey,
+			Nonce:     chat.Nonce,
+			Text:      chat.Text,
+			Signature: chat.Signature,
+		})
+	}
+
+	chunks := node.chatLogMessages()
+	if len(chunks) < 2 {
+		t.Fatal("chat log was not split")
+	}
+
+	entries := 0
+	for _, chunk := range chunks {
+		encoded, err := message.Encode(chunk, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Encrypted frames also carry a sequence number and a tag
+		if size := len(encoded) - message.FrameHeaderSize + message.SequenceSize + 16; size > 1024 {
+			t.Fatalf("chunk of %d bytes exceeds the maximum frame size", size)
+		}
+
+		entries += len(chunk.Entries)
+	}
+
+	if entries != 50 {
+		t.Fatalf("expected 50 entries, got %d", entries)
+	}
+}
+
+func TestNode_FindNextSuccessorAfterLeave(t *testing.T) {
+	peer1, peer2 := pipePeers(t)
+	defer peer2.Close()
+
+	// The failed successor has already left the ring, so the
+	// node is alone by the time stabilization notices the failure
+	node := peer1.node
+	node.successor = nil
+
+	if err := node.findNextSuccessor(peer1); err != nil {
+		t.Fatal(err)
+	}
+
+	if node.Successor() != nil {
+		t.Fatal("successor was replaced")
+	}
+
+	select {
+	case <-peer1.closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("failed successor was not closed")
+	}
+}
+
+func TestNode_DropMisaddressedPrivateChat(t *testing.T) {
+	peer1, peer2 := pipePeers(t)
+	defer peer1.Close()
+	defer peer2.Close()
+
+	node := peer1.node
+	node.successor = peer1
+
+	_, other, _ := ed25519.GenerateKey()
+	node.handleMessage(peer1, message.Envelope{Message: message.PrivateChat{
+		Sender:    peer2.node.PublicKey(),
+		PublicKey: other,
+	}})
+
+	select {
+	case <-peer2.Incoming():
+		t.Fatal("misaddressed message was relayed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
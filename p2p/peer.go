@@ -0,0 +1,495 @@
+package p2p
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/message"
+	"github.com/hasyimibhar/p2p-chat/x25519"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	SharedSecretSize = 32
+)
+
+// Peer represents another node in the network.
+type Peer struct {
+	node            *Node
+	conn            net.Conn
+	reader          *message.FrameReader
+	writer          *message.FrameWriter
+	listenAddr      string
+	pubkey          []byte
+	agreementKey    []byte
+	capabilities    message.Capabilities
+	initiator       bool
+	secret          []byte
+	sendSuite       cipher.AEAD
+	recvSuite       cipher.AEAD
+	sendSeq         uint64
+	recvSeq         uint64
+	sendMtx         sync.Mutex
+	lastActive      time.Time
+	closed          bool
+	closingCh       chan struct{}
+	closeCh         chan struct{}
+	incomingCh      chan message.Envelope
+	requests        map[uint32]chan message.Message
+	lastRequestID   uint32
+	mtx             sync.Mutex
+	handshakeDoneCh chan struct{}
+}
+
+// NewPeer creates a peer. The initiator is the side that
+// dialed the connection.
+func NewPeer(node *Node, conn net.Conn, initiator bool) *Peer {
+	peer := &Peer{
+		node:            node,
+		conn:            conn,
+		reader:          message.NewFrameReader(conn, node.config.MaxFrameSize),
+		writer:          message.NewFrameWriter(conn, node.config.MaxFrameSize),
+		initiator:       initiator,
+		closingCh:       make(chan struct{}),
+		closeCh:         make(chan struct{}),
+		handshakeDoneCh: make(chan struct{}),
+		incomingCh:      make(chan message.Envelope),
+		requests:        map[uint32]chan message.Message{},
+		lastActive:      node.config.Clock.Now(),
+	}
+
+	go peer.handleReceive()
+
+	return peer
+}
+
+func (p *Peer) Addr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *Peer) ListenAddr() string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.listenAddr
+}
+
+func (p *Peer) PublicKey() []byte {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.pubkey
+}
+
+// LastActive returns when a message was last sent
+// to or received from the peer.
+func (p *Peer) LastActive() time.Time {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.lastActive
+}
+
+func (p *Peer) touch() {
+	now := p.node.config.Clock.Now()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.lastActive = now
+}
+
+// Capabilities returns the capabilities negotiated with the peer
+// during the handshake.
+func (p *Peer) Capabilities() message.Capabilities {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.capabilities
+}
+
+func (p *Peer) cipherSuites() (send cipher.AEAD, recv cipher.AEAD) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.sendSuite, p.recvSuite
+}
+
+// SendMessage sends a message to the peer, which is
+// neither a request nor a response.
+func (p *Peer) SendMessage(msg message.Message) error {
+	return p.sendEnvelope(message.Envelope{Message: msg})
+}
+
+func (p *Peer) sendEnvelope(envelope message.Envelope) error {
+	// Sequence numbers must be assigned in the same order
+	// as the messages are written to the connection.
+	p.sendMtx.Lock()
+	defer p.sendMtx.Unlock()
+
+	suite, _ := p.cipherSuites()
+
+	seq := uint64(0)
+	if suite != nil {
+		seq = p.sendSeq + 1
+	}
+
+	encoded, err := message.EncodeEnvelope(envelope, suite, seq)
+	if err != nil {
+		return err
+	}
+
+	// log.Println("[trace] sending:", hex.EncodeToString(encoded))
+
+	if err := p.writer.WriteFrame(encoded); err != nil {
+		return err
+	}
+	p.sendSeq = seq
+	p.touch()
+
+	return nil
+}
+
+// Request sends the request to the peer and waits for its response,
+// which must have the opcode, until the context is done. Requests
+// carry an ID which the peer's response is matched with, so several
+// requests can be in flight over the same connection, and a response
+// which arrives too late is dropped.
+func (p *Peer) Request(ctx context.Context, msg message.Message, opcode message.Opcode) (message.Message, error) {
+	// The channel is buffered so that the receive loop
+	// never waits for the response to be picked up.
+	responseCh := make(chan message.Message, 1)
+
+	p.mtx.Lock()
+	p.lastRequestID++
+	if p.lastRequestID == 0 {
+		// Zero means that a message is not part of a request
+		p.lastRequestID++
+	}
+	id := p.lastRequestID
+	p.requests[id] = responseCh
+	p.mtx.Unlock()
+
+	defer func() {
+		p.mtx.Lock()
+		delete(p.requests, id)
+		p.mtx.Unlock()
+	}()
+
+	if err := p.sendEnvelope(message.Envelope{RequestID: id, Message: msg}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-responseCh:
+		if actual, _ := message.OpcodeFromMessage(response); actual != opcode {
+			return nil, fmt.Errorf("unexpected response from %s", p.ListenAddr())
+		}
+
+		return response, nil
+	case <-p.closeCh:
+		return nil, fmt.Errorf("peer %s disconnected", p.ListenAddr())
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("request to %s timed out", p.ListenAddr())
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+// Respond sends the response to the request with the ID
+// received from the peer.
+func (p *Peer) Respond(requestID uint32, msg message.Message) error {
+	return p.sendEnvelope(message.Envelope{
+		RequestID: requestID,
+		Flags:     message.FlagResponse,
+		Message:   msg,
+	})
+}
+
+// Incoming returns the channel which outputs the messages received
+// from the peer, except for responses, which go to their request.
+// Requests which the peer expects an answer to have an ID.
+func (p *Peer) Incoming() <-chan message.Envelope {
+	return p.incomingCh
+}
+
+func (p *Peer) handleReceive() {
+	defer close(p.closeCh)
+
+	// Whether the peer has sent its handshake, which
+	// must come before any encrypted frame
+	handshakeReceived := false
+
+	for {
+		header, msgbuf, err := p.reader.ReadFrame()
+		switch err {
+		case nil:
+		case io.EOF:
+			return
+		case message.ErrFrameTooLarge, message.ErrUnsupportedVersion,
+			message.ErrTruncatedFrame, message.ErrMalformedFrame:
+			// The stream can't be resynchronized, so
+			// drop the connection.
+			log.Println("[error] failed to read frame:", err)
+			p.conn.Close()
+			return
+		default:
+			// log.Println("[error] failed to read from peer:", err)
+			return
+		}
+
+		// log.Println("[trace] received:", hex.EncodeToString(msgbuf))
+
+		// Encrypted frames can only be decoded after the
+		// cryptographic handshake is complete, which may
+		// still fail, e.g. if the handshake is forged.
+		if header.Encrypted() {
+			if !handshakeReceived {
+				log.Println("[error] received encrypted frame before the handshake")
+				p.conn.Close()
+				return
+			}
+
+			select {
+			case <-p.handshakeDoneCh:
+			case <-p.closingCh:
+				return
+			}
+		}
+
+		_, suite := p.cipherSuites()
+
+		seq := uint64(0)
+		if suite != nil {
+			seq = p.recvSeq + 1
+		}
+
+		envelope, err := message.DecodeEnvelope(msgbuf, suite, seq)
+		if err != nil {
+			// Drop the connection, since the message is either
+			// corrupted, replayed or forged.
+			log.Println("[error] failed to decode message:", err)
+			p.conn.Close()
+			return
+		}
+		p.recvSeq = seq
+		p.touch()
+
+		if _, ok := envelope.Message.(message.Handshake); ok {
+			handshakeReceived = true
+		}
+
+		if envelope.IsResponse() {
+			p.mtx.Lock()
+			responseCh, ok := p.requests[envelope.RequestID]
+			delete(p.requests, envelope.RequestID)
+			p.mtx.Unlock()
+
+			// Nobody waits for the response if the request has
+			// been given up on, or if the peer made it up
+			if ok {
+				responseCh <- envelope.Message
+			}
+			continue
+		}
+
+		// The dispatcher may have stopped, which must
+		// not prevent the peer from closing.
+		select {
+		case p.incomingCh <- envelope:
+		case <-p.closingCh:
+			return
+		}
+	}
+}
+
+// HandshakeTranscript holds the messages sent and received by the
+// node during the handshake.
+type HandshakeTranscript struct {
+	LocalChallenge  message.HandshakeChallenge
+	RemoteChallenge message.HandshakeChallenge
+	Local           message.Handshake
+	Remote          message.Handshake
+}
+
+// PerformHandshake initializes the peer's AEAD cipher which
+// completes the cryptographic handshake. ephemeralPrivkey is the
+// private half of the ephemeral key sent in transcript.Local, and
+// capabilities are the capabilities negotiated with the peer.
+func (p *Peer) PerformHandshake(transcript HandshakeTranscript, ephemeralPrivkey []byte, capabilities message.Capabilities) error {
+	p.mtx.Lock()
+	p.pubkey = transcript.Remote.PublicKey
+	p.agreementKey = transcript.Remote.AgreementKey
+	p.listenAddr = transcript.Remote.Addr
+	p.capabilities = capabilities
+	p.mtx.Unlock()
+
+	if err := p.initAEAD(transcript, ephemeralPrivkey); err != nil {
+		return err
+	}
+
+	close(p.handshakeDoneCh)
+
+	return nil
+}
+
+func (p *Peer) initAEAD(transcript HandshakeTranscript, ephemeralPrivkey []byte) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	remote := transcript.Remote
+
+	ephemeralSecret, err := x25519.ComputeSharedSecret(ephemeralPrivkey, remote.EphemeralKey)
+	if err != nil {
+		return err
+	}
+
+	staticSecret, err := x25519.ComputeSharedSecret(p.node.AgreementPrivateKey(), remote.AgreementKey)
+	if err != nil {
+		return err
+	}
+
+	hash, err := transcript.hash(p.initiator)
+	if err != nil {
+		return err
+	}
+
+	p.secret, err = deriveSessionKey(ephemeralSecret, staticSecret, hash)
+	if err != nil {
+		return err
+	}
+
+	// Use a separate key for each direction, so that both sides
+	// can count their sequence numbers (and hence nonces) from 1.
+	initiatorKey, responderKey, err := deriveDirectionKeys(p.secret)
+	if err != nil {
+		return err
+	}
+
+	sendKey, recvKey := initiatorKey, responderKey
+	if !p.initiator {
+		sendKey, recvKey = responderKey, initiatorKey
+	}
+
+	p.sendSuite, err = chacha20poly1305.NewX(sendKey)
+	if err != nil {
+		return err
+	}
+
+	p.recvSuite, err = chacha20poly1305.NewX(recvKey)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deriveDirectionKeys derives the keys used to encrypt messages
+// sent by the initiator and by the responder from the session key.
+func deriveDirectionKeys(secret []byte) ([]byte, []byte, error) {
+	hkdf := hkdf.New(sha256.New, secret, nil, []byte("p2p-chat transport keys"))
+
+	keys := make([]byte, 2*SharedSecretSize)
+	if _, err := hkdf.Read(keys); err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key")
+	}
+
+	return keys[:SharedSecretSize], keys[SharedSecretSize:], nil
+}
+
+// hash hashes every message exchanged during the handshake, so that the
+// session key is bound to all of them. In particular, tampering with the
+// advertised versions or capabilities results in mismatched session keys.
+// The messages are always ordered initiator first, so that both sides
+// agree on the hash.
+func (t HandshakeTranscript) hash(initiator bool) ([]byte, error) {
+	messages := []message.Message{t.LocalChallenge, t.RemoteChallenge, t.Local, t.Remote}
+	if !initiator {
+		messages = []message.Message{t.RemoteChallenge, t.LocalChallenge, t.Remote, t.Local}
+	}
+
+	hash := sha256.New()
+
+	for _, m := range messages {
+		encoded, err := m.Encode()
+		if err != nil {
+			return nil, err
+		}
+
+		hash.Write(encoded)
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// deriveSessionKey derives the session key from the ephemeral and static
+// Diffie-Hellman outputs. Since the ephemeral keys are discarded after the
+// handshake, compromising the node's long-term keys does not reveal the
+// keys of past sessions.
+func deriveSessionKey(ephemeralSecret []byte, staticSecret []byte, transcript []byte) ([]byte, error) {
+	ikm := append(append([]byte{}, ephemeralSecret...), staticSecret...)
+	hkdf := hkdf.New(sha256.New, ikm, transcript, []byte("p2p-chat session key"))
+
+	secret := make([]byte, SharedSecretSize)
+	if _, err := hkdf.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to derive key")
+	}
+
+	return secret, nil
+}
+
+// ExportKey derives a key from the connection's session key, e.g. to
+// bootstrap an end-to-end encrypted session with the peer. The label
+// separates keys exported for different purposes.
+func (p *Peer) ExportKey(label string) ([]byte, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.secret == nil {
+		return nil, fmt.Errorf("handshake is not complete")
+	}
+
+	hkdf := hkdf.New(sha256.New, p.secret, nil, []byte(label))
+
+	key := make([]byte, SharedSecretSize)
+	if _, err := hkdf.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to derive key")
+	}
+
+	return key, nil
+}
+
+// disconnected returns true once the connection to the
+// peer is lost, or closed by the node.
+func (p *Peer) disconnected() bool {
+	select {
+	case <-p.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Peer) Close() {
+	p.mtx.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.closingCh)
+	}
+	p.mtx.Unlock()
+
+	// The receive loop may need the lock to finish
+	// handling the current frame.
+	p.conn.Close()
+	<-p.closeCh
+}
@@ -0,0 +1,405 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/clock"
+	"github.com/hasyimibhar/p2p-chat/message"
+	"github.com/hasyimibhar/p2p-chat/x25519"
+)
+
+func TestPeer_HandshakeFreshSessionKeys(t *testing.T) {
+	node1, err := NewNode(Config{Addr: "localhost:8001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node2, err := NewNode(Config{Addr: "localhost:8002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiator1, responder1 := handshakePeers(t, node1, node2)
+	initiator2, responder2 := handshakePeers(t, node1, node2)
+
+	for _, peer := range []*Peer{initiator1, responder1, initiator2, responder2} {
+		defer peer.Close()
+	}
+
+	if !bytes.Equal(initiator1.secret, responder1.secret) {
+		t.Fatal("peers derived different session keys")
+	}
+	if !bytes.Equal(initiator2.secret, responder2.secret) {
+		t.Fatal("peers derived different session keys")
+	}
+
+	if bytes.Equal(initiator1.secret, initiator2.secret) {
+		t.Fatal("two connections derived the same session key")
+	}
+
+	if initiator1.Capabilities() != SupportedCapabilities {
+		t.Fatal("incorrect negotiated capabilities")
+	}
+}
+
+// handshakePeers connects two nodes over an in-memory pipe and performs
+// the cryptographic handshake on both ends.
+func handshakePeers(t *testing.T, initiator *Node, responder *Node) (*Peer, *Peer) {
+	conn1, conn2 := net.Pipe()
+
+	peer1 := NewPeer(initiator, conn1, true)
+	peer2 := NewPeer(responder, conn2, false)
+
+	errCh := make(chan error)
+	go func() { errCh <- responder.performHandshake(peer2, nil) }()
+
+	if err := initiator.performHandshake(peer1, responder.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	return peer1, peer2
+}
+
+func TestPeer_HandshakeUnexpectedKey(t *testing.T) {
+	node1, _ := NewNode(Config{Addr: "localhost:8001"})
+	node2, _ := NewNode(Config{Addr: "localhost:8002"})
+	node3, _ := NewNode(Config{Addr: "localhost:8003"})
+
+	conn1, conn2 := net.Pipe()
+
+	peer1 := NewPeer(node1, conn1, true)
+	defer peer1.Close()
+	peer2 := NewPeer(node2, conn2, false)
+	defer peer2.Close()
+
+	go node2.performHandshake(peer2, nil)
+
+	// node1 dialed expecting node3, but node2 answered
+	if err := node1.performHandshake(peer1, node3.PublicKey()); err == nil {
+		t.Fatal("expected handshake to fail")
+	}
+}
+
+func TestPeer_HandshakeUnreachableAddr(t *testing.T) {
+	node1, _ := NewNode(Config{Addr: "localhost:8001"})
+	node2, _ := NewNode(Config{Addr: "0.0.0.0:8002"})
+
+	conn1, conn2 := net.Pipe()
+
+	peer1 := NewPeer(node1, conn1, true)
+	defer peer1.Close()
+	peer2 := NewPeer(node2, conn2, false)
+	defer peer2.Close()
+
+	go node2.performHandshake(peer2, nil)
+
+	// Other peers would be told to connect to node2 at an
+	// address where it can't be reached
+	if err := node1.performHandshake(peer1, node2.PublicKey()); err == nil {
+		t.Fatal("expected handshake to fail")
+	}
+}
+
+func TestPeer_HandshakeReplay(t *testing.T) {
+	node1, _ := NewNode(Config{Addr: "localhost:8001"})
+	node2, _ := NewNode(Config{Addr: "localhost:8002"})
+
+	// Record a valid handshake from node2, signed for some other challenge
+	challenge, _ := message.NewHandshakeChallenge(SupportedCapabilities)
+	_, ephemeralKey, _ := x25519.GenerateKey()
+	recorded, _ := message.NewHandshake(node2.PrivateKey(), node2.PublicKey(),
+		node2.AgreementPublicKey(), ephemeralKey, challenge.Nonce, node2.Addr())
+
+	conn1, conn2 := net.Pipe()
+
+	peer1 := NewPeer(node1, conn1, true)
+	defer peer1.Close()
+	attacker := NewPeer(node2, conn2, false)
+	defer attacker.Close()
+
+	go func() {
+		attackerChallenge, _ := message.NewHandshakeChallenge(SupportedCapabilities)
+		attacker.SendMessage(attackerChallenge)
+		<-attacker.Incoming()
+
+		attacker.SendMessage(recorded)
+		<-attacker.Incoming()
+	}()
+
+	if err := node1.performHandshake(peer1, node2.PublicKey()); err == nil {
+		t.Fatal("expected replayed handshake to be rejected")
+	}
+}
+
+func TestPeer_HandshakeIncompatiblePeer(t *testing.T) {
+	node1, _ := NewNode(Config{Addr: "localhost:8001"})
+	node2, _ := NewNode(Config{Addr: "localhost:8002"})
+
+	tests := []message.HandshakeChallenge{
+		{Version: message.MinProtocolVersion - 1, Capabilities: SupportedCapabilities},
+		{Version: message.ProtocolVersion, Capabilities: SupportedCapabilities &^ RequiredCapabilities},
+	}
+
+	for _, tt := range tests {
+		conn1, conn2 := net.Pipe()
+
+		peer1 := NewPeer(node1, conn1, true)
+		remote := NewPeer(node2, conn2, false)
+
+		go func(challenge message.HandshakeChallenge) {
+			challenge.Nonce = make([]byte, message.ChallengeSize)
+			remote.SendMessage(challenge)
+			<-remote.Incoming()
+		}(tt)
+
+		if err := node1.performHandshake(peer1, nil); err == nil {
+			t.Fatal("expected incompatible peer to be refused")
+		}
+
+		peer1.Close()
+		remote.Close()
+	}
+}
+
+func TestPeer_HandshakeTimeout(t *testing.T) {
+	c := clock.NewMock(time.Unix(0, 0))
+	node, _ := NewNode(Config{Addr: "node1", Clock: c})
+
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+
+	// The other side reads everything but never answers
+	go io.Copy(ioutil.Discard, conn2)
+
+	peer := NewPeer(node, conn1, true)
+	defer peer.Close()
+
+	errCh := make(chan error)
+	go func() { errCh <- node.performHandshake(peer, nil) }()
+
+	for c.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Advance(node.Config().HandshakeTimeout)
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected handshake to time out")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake did not time out")
+	}
+}
+
+// duplicatingConn writes everything twice once duplicate is set,
+// simulating an attacker replaying recorded frames.
+type duplicatingConn struct {
+	net.Conn
+	duplicate bool
+}
+
+func (c *duplicatingConn) Write(b []byte) (int, error) {
+	if c.duplicate {
+		if _, err := c.Conn.Write(b); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.Conn.Write(b)
+}
+
+func TestPeer_EncryptedFrameBeforeHandshake(t *testing.T) {
+	node, _ := NewNode(Config{Addr: "localhost:8001"})
+
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+
+	peer := NewPeer(node, conn2, false)
+
+	go io.Copy(ioutil.Discard, conn1)
+	go func() {
+		// Answer the challenge, then skip the handshake
+		challenge, _ := message.NewHandshakeChallenge(SupportedCapabilities)
+		encoded, _ := message.Encode(challenge, nil, 0)
+		conn1.Write(encoded)
+
+		header := message.FrameHeader{
+			Version: message.FrameVersion,
+			Flags:   message.FlagEncrypted,
+			Length:  32,
+		}
+		conn1.Write(append(header.Encode(), make([]byte, 32)...))
+	}()
+
+	if err := node.performHandshake(peer, nil); err == nil {
+		t.Fatal("expected handshake to fail")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		peer.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("peer did not close")
+	}
+}
+
+func TestPeer_ReplayedFrameDropsConnection(t *testing.T) {
+	node1, _ := NewNode(Config{Addr: "localhost:8001"})
+	node2, _ := NewNode(Config{Addr: "localhost:8002"})
+
+	conn1, conn2 := net.Pipe()
+	conn := &duplicatingConn{Conn: conn1}
+
+	peer1 := NewPeer(node1, conn, true)
+	defer peer1.Close()
+	peer2 := NewPeer(node2, conn2, false)
+	defer peer2.Close()
+
+	errCh := make(chan error)
+	go func() { errCh <- node2.performHandshake(peer2, nil) }()
+
+	if err := node1.performHandshake(peer1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	conn.duplicate = true
+	go peer1.SendMessage(message.Ping{})
+
+	<-peer2.Incoming()
+
+	select {
+	case <-peer2.closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be dropped")
+	}
+}
+
+func TestPeer_OversizedFrameDropsConnection(t *testing.T) {
+	node, _ := NewNode(Config{Addr: "localhost:8001"})
+
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+
+	peer := NewPeer(node, conn2, false)
+	defer peer.Close()
+
+	// Announce a frame larger than the limit
+	header := message.FrameHeader{
+		Version: message.FrameVersion,
+		Length:  node.Config().MaxFrameSize + 1,
+	}
+	if _, err := conn1.Write(header.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-peer.closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be dropped")
+	}
+}
+
+// pipePeers returns both ends of a connection
+// between two nodes which have completed the handshake.
+func pipePeers(t *testing.T) (*Peer, *Peer) {
+	node1, _ := NewNode(Config{Addr: "localhost:8001"})
+	node2, _ := NewNode(Config{Addr: "localhost:8002"})
+
+	return handshakePeers(t, node1, node2)
+}
+
+func TestPeer_ConcurrentRequests(t *testing.T) {
+	peer1, peer2 := pipePeers(t)
+	defer peer1.Close()
+	defer peer2.Close()
+
+	pingCh := make(chan error)
+	go func() {
+		_, err := peer1.Request(context.Background(), message.Ping{}, message.OpcodePong)
+		pingCh <- err
+	}()
+
+	ping := <-peer2.Incoming()
+
+	fetchCh := make(chan message.Message)
+	go func() {
+		response, err := peer1.Request(context.Background(), message.FetchRequest{Key: make([]byte, IDSize)}, message.OpcodeFetchResponse)
+		if err != nil {
+			t.Error(err)
+		}
+		fetchCh <- response
+	}()
+
+	fetch := <-peer2.Incoming()
+	if ping.RequestID == fetch.RequestID {
+		t.Fatal("requests share the same ID")
+	}
+
+	// Responses are matched with their request regardless of their order
+	if err := peer2.Respond(fetch.RequestID, message.FetchResponse{Found: true}); err != nil {
+		t.Fatal(err)
+	}
+	if response, ok := (<-fetchCh).(message.FetchResponse); !ok || !response.Found {
+		t.Fatal("incorrect response")
+	}
+
+	if err := peer2.Respond(ping.RequestID, message.Pong{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-pingCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeer_RequestTimeout(t *testing.T) {
+	peer1, peer2 := pipePeers(t)
+	defer peer1.Close()
+	defer peer2.Close()
+
+	go func() {
+		// Answer the first request too late, and
+		// the second one with an unexpected message
+		late := <-peer2.Incoming()
+		unexpected := <-peer2.Incoming()
+
+		peer2.Respond(late.RequestID, message.Pong{})
+		peer2.Respond(unexpected.RequestID, message.StoreResponse{})
+
+		ping := <-peer2.Incoming()
+		peer2.Respond(ping.RequestID, message.Pong{})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := peer1.Request(ctx, message.Ping{}, message.OpcodePong); err == nil {
+		t.Fatal("expected request to time out")
+	}
+
+	if _, err := peer1.Request(context.Background(), message.Ping{}, message.OpcodePong); err == nil {
+		t.Fatal("expected unexpected response to be rejected")
+	}
+
+	// The late response was dropped without holding up the connection
+	if _, err := peer1.Request(context.Background(), message.Ping{}, message.OpcodePong); err != nil {
+		t.Fatal(err)
+	}
+}
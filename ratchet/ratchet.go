@@ -0,0 +1,394 @@
+// Package ratchet implements the Double Ratchet algorithm used to
+// encrypt private chat messages, as described in
+// https://signal.org/docs/specifications/doubleratchet/.
+//
+// Every message is encrypted with a fresh message key, so compromising
+// a session's current state does not reveal past messages (forward
+// secrecy), and the Diffie-Hellman ratchet heals the session once new
+// key pairs are exchanged (post-compromise security).
+package ratchet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/hasyimibhar/p2p-chat/x25519"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MaxSkip is the maximum number of message keys that can be
+	// skipped in a single chain, which bounds the work an attacker
+	// can force by sending a message with a large message number.
+	MaxSkip = 1000
+
+	// MaxSkippedKeys is the maximum number of skipped message keys
+	// kept for out-of-order messages. The oldest keys are evicted
+	// first.
+	MaxSkippedKeys = 2000
+
+	HeaderSize = x25519.KeySize + 8
+)
+
+var (
+	ErrTooManySkipped = fmt.Errorf("too many skipped messages")
+	ErrDecrypt        = fmt.Errorf("failed to decrypt message")
+	ErrNotReady       = fmt.Errorf("session has no sending chain")
+)
+
+// Header is sent in the clear along with each encrypted message.
+type Header struct {
+	// PublicKey is the sender's current ratchet public key.
+	PublicKey []byte
+	// PreviousChainLength is the number of messages in the
+	// sender's previous sending chain.
+	PreviousChainLength uint32
+	// MessageNumber is the message's number in the sending chain.
+	MessageNumber uint32
+}
+
+func (h Header) Encode() []byte {
+	encoded := make([]byte, HeaderSize)
+	copy(encoded, h.PublicKey)
+	binary.BigEndian.PutUint32(encoded[x25519.KeySize:], h.PreviousChainLength)
+	binary.BigEndian.PutUint32(encoded[x25519.KeySize+4:], h.MessageNumber)
+	return encoded
+}
+
+func DecodeHeader(buf []byte) (Header, error) {
+	if len(buf) != HeaderSize {
+		return Header{}, fmt.Errorf("invalid header size")
+	}
+
+	return Header{
+		PublicKey:           buf[:x25519.KeySize],
+		PreviousChainLength: binary.BigEndian.Uint32(buf[x25519.KeySize:]),
+		MessageNumber:       binary.BigEndian.Uint32(buf[x25519.KeySize+4:]),
+	}, nil
+}
+
+type skippedKey struct {
+	publicKey     string
+	messageNumber uint32
+}
+
+// Session is one side of a Double Ratchet session.
+type Session struct {
+	mtx sync.Mutex
+	state
+}
+
+type state struct {
+	dhPrivkey    []byte
+	dhPubkey     []byte
+	remoteDH     []byte
+	rootKey      []byte
+	sendChainKey []byte
+	recvChainKey []byte
+	sendN        uint32
+	recvN        uint32
+	prevN        uint32
+	skipped      map[skippedKey][]byte
+	skippedOrder []skippedKey
+}
+
+// NewInitiatorSession creates the session of the side which knows the
+// other side's ratchet public key. secret is the shared secret both sides
+// agreed on.
+func NewInitiatorSession(secret []byte, remotePubkey []byte) (*Session, error) {
+	privkey, pubkey, err := x25519.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{state: state{
+		dhPrivkey: privkey,
+		dhPubkey:  pubkey,
+		remoteDH:  remotePubkey,
+		skipped:   map[skippedKey][]byte{},
+	}}
+
+	dh, err := x25519.ComputeSharedSecret(privkey, remotePubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rootKey, s.sendChainKey, err = kdfRootKey(secret, dh)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewResponderSession creates the session of the side whose ratchet key
+// pair was used by the initiator. remotePubkey is the initiator's ratchet
+// public key, which allows the responder to send messages before receiving
+// any from the initiator.
+func NewResponderSession(secret []byte, privkey []byte, pubkey []byte, remotePubkey []byte) (*Session, error) {
+	s := &Session{state: state{
+		dhPrivkey: privkey,
+		dhPubkey:  pubkey,
+		rootKey:   secret,
+		skipped:   map[skippedKey][]byte{},
+	}}
+
+	if err := s.dhRatchet(Header{PublicKey: remotePubkey}); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// PublicKey returns the session's current ratchet public key.
+func (s *Session) PublicKey() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.dhPubkey
+}
+
+// Encrypt encrypts the plaintext with the next message key. The associated
+// data is authenticated along with the header, but not sent.
+func (s *Session) Encrypt(plaintext []byte, ad []byte) (Header, []byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.sendChainKey == nil {
+		return Header{}, nil, ErrNotReady
+	}
+
+	var messageKey []byte
+	s.sendChainKey, messageKey = kdfChainKey(s.sendChainKey)
+
+	header := Header{
+		PublicKey:           s.dhPubkey,
+		PreviousChainLength: s.prevN,
+		MessageNumber:       s.sendN,
+	}
+	s.sendN++
+
+	ciphertext, err := seal(messageKey, plaintext, append(append([]byte{}, ad...), header.Encode()...))
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	return header, ciphertext, nil
+}
+
+// Decrypt decrypts a message, advancing the ratchet as needed. Messages
+// may arrive out of order; the keys of skipped messages are kept until
+// they arrive. The session is left unchanged if decryption fails.
+func (s *Session) Decrypt(header Header, ciphertext []byte, ad []byte) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ad = append(append([]byte{}, ad...), header.Encode()...)
+
+	key := skippedKey{string(header.PublicKey), header.MessageNumber}
+	if messageKey, ok := s.skipped[key]; ok {
+		plaintext, err := open(messageKey, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+
+		s.deleteSkipped(key)
+		return plaintext, nil
+	}
+
+	backup := s.state.clone()
+
+	plaintext, err := s.decrypt(header, ciphertext, ad)
+	if err != nil {
+		s.state = backup
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+func (s *Session) decrypt(header Header, ciphertext []byte, ad []byte) ([]byte, error) {
+	if !bytes.Equal(header.PublicKey, s.remoteDH) {
+		if err := s.skipMessageKeys(header.PreviousChainLength); err != nil {
+			return nil, err
+		}
+
+		if err := s.dhRatchet(header); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.skipMessageKeys(header.MessageNumber); err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	s.recvChainKey, messageKey = kdfChainKey(s.recvChainKey)
+	s.recvN++
+
+	return open(messageKey, ciphertext, ad)
+}
+
+func (s *Session) skipMessageKeys(until uint32) error {
+	if s.recvChainKey == nil {
+		return nil
+	}
+
+	if until < s.recvN {
+		// The message is older than the chain's position, and its
+		// key is not in the skipped keys, e.g. a replayed message.
+		return ErrDecrypt
+	}
+
+	if until-s.recvN > MaxSkip {
+		return ErrTooManySkipped
+	}
+
+	for s.recvN < until {
+		var messageKey []byte
+		s.recvChainKey, messageKey = kdfChainKey(s.recvChainKey)
+
+		key := skippedKey{string(s.remoteDH), s.recvN}
+		s.skipped[key] = messageKey
+		s.skippedOrder = append(s.skippedOrder, key)
+		s.recvN++
+	}
+
+	// Evict the oldest skipped keys
+	for len(s.skippedOrder) > MaxSkippedKeys {
+		delete(s.skipped, s.skippedOrder[0])
+		s.skippedOrder = s.skippedOrder[1:]
+	}
+
+	return nil
+}
+
+func (s *Session) deleteSkipped(key skippedKey) {
+	delete(s.skipped, key)
+
+	for i, k := range s.skippedOrder {
+		if k == key {
+			s.skippedOrder = append(s.skippedOrder[:i:i], s.skippedOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *Session) dhRatchet(header Header) error {
+	s.prevN = s.sendN
+	s.sendN = 0
+	s.recvN = 0
+	s.remoteDH = header.PublicKey
+
+	dh, err := x25519.ComputeSharedSecret(s.dhPrivkey, s.remoteDH)
+	if err != nil {
+		return err
+	}
+
+	s.rootKey, s.recvChainKey, err = kdfRootKey(s.rootKey, dh)
+	if err != nil {
+		return err
+	}
+
+	s.dhPrivkey, s.dhPubkey, err = x25519.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	dh, err = x25519.ComputeSharedSecret(s.dhPrivkey, s.remoteDH)
+	if err != nil {
+		return err
+	}
+
+	s.rootKey, s.sendChainKey, err = kdfRootKey(s.rootKey, dh)
+	return err
+}
+
+func (st state) clone() state {
+	skipped := make(map[skippedKey][]byte, len(st.skipped))
+	for k, v := range st.skipped {
+		skipped[k] = v
+	}
+
+	st.skipped = skipped
+	st.skippedOrder = append([]skippedKey{}, st.skippedOrder...)
+	return st
+}
+
+// kdfRootKey derives a new root key and chain key from the current
+// root key and a Diffie-Hellman output.
+func kdfRootKey(rootKey []byte, dh []byte) ([]byte, []byte, error) {
+	kdf := hkdf.New(sha256.New, dh, rootKey, []byte("p2p-chat ratchet"))
+
+	out := make([]byte, 64)
+	if _, err := kdf.Read(out); err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key")
+	}
+
+	return out[:32], out[32:], nil
+}
+
+// kdfChainKey derives the next chain key and a message key
+// from the current chain key.
+func kdfChainKey(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	nextChainKey := mac.Sum(nil)
+
+	return nextChainKey, messageKey
+}
+
+// messageCipher derives the AEAD key and nonce from a message key. Since
+// each message key is used only once, the nonce can be deterministic.
+func messageCipher(messageKey []byte) ([]byte, []byte, error) {
+	kdf := hkdf.New(sha256.New, messageKey, nil, []byte("p2p-chat message key"))
+
+	out := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSizeX)
+	if _, err := kdf.Read(out); err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key")
+	}
+
+	return out[:chacha20poly1305.KeySize], out[chacha20poly1305.KeySize:], nil
+}
+
+func seal(messageKey []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return suite.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func open(messageKey []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	suite, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := suite.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
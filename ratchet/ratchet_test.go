@@ -0,0 +1,168 @@
+package ratchet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/hasyimibhar/p2p-chat/x25519"
+)
+
+type envelope struct {
+	header     Header
+	ciphertext []byte
+}
+
+func newSessions(t *testing.T) (*Session, *Session) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	responderPrivkey, responderPubkey, _ := x25519.GenerateKey()
+
+	alice, err := NewInitiatorSession(secret, responderPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := NewResponderSession(secret, responderPrivkey, responderPubkey, alice.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return alice, bob
+}
+
+func encrypt(t *testing.T, s *Session, text string) envelope {
+	header, ciphertext, err := s.Encrypt([]byte(text), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return envelope{header, ciphertext}
+}
+
+func decrypt(t *testing.T, s *Session, e envelope, expected string) {
+	plaintext, err := s.Decrypt(e.header, e.ciphertext, []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(plaintext) != expected {
+		t.Fatal("decrypted message is incorrect")
+	}
+}
+
+func TestSession_EncryptDecrypt(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	// Both sides can send before receiving anything
+	decrypt(t, alice, encrypt(t, bob, "hello alice"), "hello alice")
+	decrypt(t, bob, encrypt(t, alice, "hello bob"), "hello bob")
+
+	for i := 0; i < 3; i++ {
+		decrypt(t, bob, encrypt(t, alice, "lorem ipsum"), "lorem ipsum")
+		decrypt(t, bob, encrypt(t, alice, "dolor sit amet"), "dolor sit amet")
+		decrypt(t, alice, encrypt(t, bob, "consectetur adipiscing elit"), "consectetur adipiscing elit")
+	}
+}
+
+func TestSession_KeysEvolve(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	e1 := encrypt(t, alice, "lorem ipsum")
+	e2 := encrypt(t, alice, "lorem ipsum")
+
+	if bytes.Equal(e1.ciphertext, e2.ciphertext) {
+		t.Fatal("same message key used twice")
+	}
+
+	pubkey := alice.PublicKey()
+	decrypt(t, bob, e1, "lorem ipsum")
+	decrypt(t, alice, encrypt(t, bob, "dolor sit amet"), "dolor sit amet")
+
+	if bytes.Equal(pubkey, alice.PublicKey()) {
+		t.Fatal("ratchet key was not rotated")
+	}
+}
+
+func TestSession_OutOfOrder(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	e1 := encrypt(t, alice, "one")
+	e2 := encrypt(t, alice, "two")
+	e3 := encrypt(t, alice, "three")
+
+	decrypt(t, bob, e3, "three")
+
+	// Messages from the previous chain arrive after a ratchet step
+	decrypt(t, alice, encrypt(t, bob, "four"), "four")
+	e5 := encrypt(t, alice, "five")
+
+	decrypt(t, bob, e5, "five")
+	decrypt(t, bob, e1, "one")
+	decrypt(t, bob, e2, "two")
+}
+
+func TestSession_Replay(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	e1 := encrypt(t, alice, "one")
+	e2 := encrypt(t, alice, "two")
+
+	decrypt(t, bob, e2, "two")
+	decrypt(t, bob, e1, "one")
+
+	if _, err := bob.Decrypt(e1.header, e1.ciphertext, []byte("ad")); err == nil {
+		t.Fatal("expected replayed message to be rejected")
+	}
+	if _, err := bob.Decrypt(e2.header, e2.ciphertext, []byte("ad")); err == nil {
+		t.Fatal("expected replayed message to be rejected")
+	}
+}
+
+func TestSession_TooManySkipped(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	for i := 0; i < MaxSkip+1; i++ {
+		encrypt(t, alice, "lost")
+	}
+
+	e := encrypt(t, alice, "too far ahead")
+	if _, err := bob.Decrypt(e.header, e.ciphertext, []byte("ad")); err != ErrTooManySkipped {
+		t.Fatal("expected too many skipped messages error")
+	}
+}
+
+func TestSession_TamperedMessageKeepsState(t *testing.T) {
+	alice, bob := newSessions(t)
+
+	e := encrypt(t, alice, "lorem ipsum")
+
+	tampered := e
+	tampered.ciphertext = append([]byte{}, e.ciphertext...)
+	tampered.ciphertext[0] ^= 0xff
+
+	if _, err := bob.Decrypt(tampered.header, tampered.ciphertext, []byte("ad")); err == nil {
+		t.Fatal("expected tampered message to be rejected")
+	}
+	if _, err := bob.Decrypt(e.header, e.ciphertext, []byte("other ad")); err == nil {
+		t.Fatal("expected message with wrong associated data to be rejected")
+	}
+
+	decrypt(t, bob, e, "lorem ipsum")
+}
+
+func TestHeader_EncodeDecode(t *testing.T) {
+	_, pubkey, _ := x25519.GenerateKey()
+	header := Header{PublicKey: pubkey, PreviousChainLength: 42, MessageNumber: 7}
+
+	decoded, err := DecodeHeader(header.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decoded.PublicKey, pubkey) ||
+		decoded.PreviousChainLength != 42 || decoded.MessageNumber != 7 {
+		t.Fatal("decoded header is incorrect")
+	}
+}
@@ -0,0 +1,40 @@
+package sim
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/clock"
+)
+
+// nodeClock is the clock of a single node in the network. Since the
+// goroutines of a node may create timers concurrently, the timers which
+// expire at the same time are ordered by the node which created them,
+// then by the code which did, rather than by their creation.
+type nodeClock struct {
+	mock  *clock.Mock
+	index int
+}
+
+func (c *nodeClock) Now() time.Time {
+	return c.mock.Now()
+}
+
+func (c *nodeClock) After(d time.Duration) <-chan time.Time {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	key := []string{fmt.Sprintf("%06d", c.index)}
+	for {
+		frame, more := frames.Next()
+		key = append(key, fmt.Sprintf("%s:%d", frame.Function, frame.Line))
+
+		if !more {
+			break
+		}
+	}
+
+	return c.mock.AfterKey(d, strings.Join(key, " "))
+}
@@ -0,0 +1,519 @@
+// Package sim simulates networks of many nodes in a single process, so
+// that the behaviour of the ring can be tested. Nodes talk over links
+// owned by the network, and their timers are driven by a mock clock
+// which only moves when the simulation is stepped. Joins, crashes,
+// partitions and message drops can be scripted.
+//
+// Simulations are deterministic, so that a failing run can be replayed
+// from its seed. The identities of the nodes and the frames which get
+// dropped are drawn from the seed, and the network takes one step at a
+// time: it delivers a single frame, or fires a single timer, then waits
+// until every node is done reacting before taking the next step. Frames
+// are delivered in the order they were sent in, frames sent during the
+// same step in the order of their links.
+//
+// Telling when the nodes are done relies on testing/synctest, which
+// needs Go 1.25 or later: a network must be created and used within a
+// synctest bubble.
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing/synctest"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/clock"
+	"github.com/hasyimibhar/p2p-chat/ed25519"
+	"github.com/hasyimibhar/p2p-chat/p2p"
+)
+
+// Node is a node in the simulated network.
+type Node struct {
+	*p2p.Node
+
+	mtx     sync.Mutex
+	crashed bool
+	hung    bool
+	chats   []p2p.ChatEntry
+	private []p2p.ChatEntry
+}
+
+// Crashed returns true if the node has crashed.
+func (n *Node) Crashed() bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.crashed
+}
+
+// Hung returns true if the node has hung.
+func (n *Node) Hung() bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.hung
+}
+
+// Chats returns the chat messages received by the node.
+func (n *Node) Chats() []p2p.ChatEntry {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return append([]p2p.ChatEntry{}, n.chats...)
+}
+
+// Received returns true if the node has received a chat
+// message with the text.
+func (n *Node) Received(text string) bool {
+	for _, c := range n.Chats() {
+		if c.Text == text {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReceivedPrivately returns true if the node has received a
+// private chat message with the text from the sender.
+func (n *Node) ReceivedPrivately(sender *Node, text string) bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for _, c := range n.private {
+		if c.Text == text && bytes.Equal(c.PublicKey, sender.PublicKey()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *Node) collectChats(closeCh chan struct{}) {
+	for {
+		select {
+		case chat := <-n.ChatMessages():
+			n.mtx.Lock()
+			n.chats = append(n.chats, chat)
+			n.mtx.Unlock()
+
+		case chat := <-n.PrivateChats():
+			n.mtx.Lock()
+			n.private = append(n.private, chat)
+			n.mtx.Unlock()
+
+		case <-closeCh:
+			return
+		}
+	}
+}
+
+// delivery records a segment delivered by the network,
+// which tells whether two runs are the same.
+type delivery struct {
+	from    string
+	to      string
+	size    int
+	fin     bool
+	dropped bool
+}
+
+// Network is a simulated network of nodes. A goroutine steps the
+// network whenever everything else in the bubble is blocked, i.e.
+// when the nodes are done with the previous step.
+type Network struct {
+	clock *clock.Mock
+
+	mtx        sync.Mutex
+	rng        *rand.Rand
+	nodes      []*Node
+	byAddr     map[string]*Node
+	listeners  map[string]*listener
+	links      []*link
+	dials      map[string]int
+	partitions map[string]int
+	dropRate   float64
+	step       int
+	deliveries []delivery
+	settling   []chan struct{}
+	closed     bool
+	closeCh    chan struct{}
+}
+
+// New creates an empty network, whose nodes and faults are drawn from
+// the seed. It must be called within a synctest bubble, and the network
+// must be closed before the bubble ends.
+func New(seed int64) *Network {
+	s := &Network{
+		clock:      clock.NewMock(time.Unix(0, 0)),
+		rng:        rand.New(rand.NewSource(seed)),
+		byAddr:     map[string]*Node{},
+		listeners:  map[string]*listener{},
+		dials:      map[string]int{},
+		partitions: map[string]int{},
+		closeCh:    make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+// Clock returns the clock driving the nodes.
+func (s *Network) Clock() *clock.Mock {
+	return s.clock
+}
+
+// Nodes returns every node ever added to the network,
+// including the ones which have crashed.
+func (s *Network) Nodes() []*Node {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]*Node{}, s.nodes...)
+}
+
+func (s *Network) hungLocked(addr string) bool {
+	n, ok := s.byAddr[addr]
+	return ok && n.Hung()
+}
+
+// Live returns the nodes which have not crashed.
+func (s *Network) Live() []*Node {
+	live := []*Node{}
+	for _, n := range s.Nodes() {
+		if !n.Crashed() {
+			live = append(live, n)
+		}
+	}
+
+	return live
+}
+
+// AddNode creates a node with the default configuration and starts
+// listening for peers. The node is not part of the ring until it joins
+// another node.
+func (s *Network) AddNode() (*Node, error) {
+	return s.AddNodeWithConfig(p2p.Config{})
+}
+
+// AddNodeWithConfig is like AddNode, but with the configuration. Its
+// address, transport and clock are set by the network.
+func (s *Network) AddNodeWithConfig(config p2p.Config) (*Node, error) {
+	s.mtx.Lock()
+	index := len(s.nodes)
+	addr := fmt.Sprintf("node%d", index)
+	seed := make([]byte, 32)
+	s.rng.Read(seed)
+	s.mtx.Unlock()
+
+	config.Addr = addr
+	config.Transport = &nodeTransport{network: s, addr: addr}
+	config.Clock = &nodeClock{mock: s.clock, index: index}
+
+	privkey, pubkey, err := ed25519.KeyFromSeed(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := p2p.NewNodeWithKey(config, privkey, pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{Node: node}
+
+	s.mtx.Lock()
+	s.nodes = append(s.nodes, n)
+	s.byAddr[addr] = n
+	s.mtx.Unlock()
+
+	go node.ListenForConnections()
+	go n.collectChats(s.closeCh)
+
+	s.Settle()
+
+	s.mtx.Lock()
+	_, listening := s.listeners[addr]
+	s.mtx.Unlock()
+
+	if !listening {
+		return nil, fmt.Errorf("%s failed to listen", addr)
+	}
+
+	return n, nil
+}
+
+// Join makes the node join the ring through bootstrap, and waits
+// for the network to settle.
+func (s *Network) Join(n *Node, bootstrap *Node) error {
+	if err := n.JoinPeer(bootstrap.Addr()); err != nil {
+		return err
+	}
+
+	s.Settle()
+	return nil
+}
+
+// Crash stops the node abruptly, breaking all of its connections.
+func (s *Network) Crash(n *Node) {
+	n.mtx.Lock()
+	n.crashed = true
+	n.mtx.Unlock()
+
+	s.breakLinks(func(l *link) bool {
+		return l.from == n.Addr() || l.to == n.Addr()
+	})
+
+	n.Close()
+}
+
+// Leave makes the node leave the ring gracefully, and stops it
+// once its neighbours have spliced it out.
+func (s *Network) Leave(n *Node) error {
+	if err := n.Leave(); err != nil {
+		return err
+	}
+
+	s.Settle()
+	s.Crash(n)
+	return nil
+}
+
+// Hang stops the node without breaking its connections, like a host
+// which suddenly loses power: everything the node sends is silently
+// discarded, so its peers only notice through timeouts. A hung node
+// is considered crashed.
+func (s *Network) Hang(n *Node) {
+	n.mtx.Lock()
+	n.crashed = true
+	n.hung = true
+	n.mtx.Unlock()
+
+	n.Close()
+}
+
+// Partition splits the network into groups of nodes which can only
+// reach nodes in the same group. Connections between groups are broken.
+// Nodes which are not in any group form a group of their own.
+func (s *Network) Partition(groups ...[]*Node) {
+	s.mtx.Lock()
+	s.partitions = map[string]int{}
+	for i, group := range groups {
+		for _, n := range group {
+			s.partitions[n.Addr()] = i + 1
+		}
+	}
+	s.mtx.Unlock()
+
+	s.breakLinks(func(l *link) bool {
+		return !s.reachableLocked(l.from, l.to)
+	})
+}
+
+// Heal removes all partitions.
+func (s *Network) Heal() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.partitions = map[string]int{}
+}
+
+// SetDropRate sets the probability for each frame to be dropped.
+func (s *Network) SetDropRate(rate float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.dropRate = rate
+}
+
+// Tick advances the clock by d, firing the timers which expire in the
+// meantime one at a time, and waits for the network to settle before
+// and after each.
+func (s *Network) Tick(d time.Duration) {
+	until := s.clock.Now().Add(d)
+
+	s.Settle()
+	for s.clock.FireNext(until) {
+		s.Settle()
+	}
+
+	s.clock.Advance(until.Sub(s.clock.Now()))
+}
+
+// Run ticks the clock by step until d has elapsed.
+func (s *Network) Run(d time.Duration, step time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += step {
+		s.Tick(step)
+	}
+}
+
+// Settle waits until every frame in transit has been delivered, and
+// the nodes are done reacting. The clock doesn't move in the meantime,
+// so that the nodes may still be waiting for timers.
+func (s *Network) Settle() {
+	settled := make(chan struct{})
+
+	s.mtx.Lock()
+	s.settling = append(s.settling, settled)
+	s.mtx.Unlock()
+
+	<-settled
+}
+
+// Close stops every node, and the network itself.
+func (s *Network) Close() {
+	for _, n := range s.Live() {
+		s.Crash(n)
+	}
+
+	s.breakLinks(func(l *link) bool {
+		return true
+	})
+
+	s.mtx.Lock()
+	s.closed = true
+	s.mtx.Unlock()
+
+	close(s.closeCh)
+}
+
+// run steps the network each time everything else in the bubble is
+// blocked. Frames in transit are delivered first, then whoever waits
+// for the network to settle is woken up. If nobody does, whoever drives
+// the network is waiting for the nodes, e.g. for the answer to a request
+// sent to a hung node, which only comes once the request times out, so
+// the next timer is fired.
+func (s *Network) run() {
+	for {
+		synctest.Wait()
+
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			s.drain()
+			return
+		}
+
+		s.step++
+		if s.deliverLocked() {
+			s.mtx.Unlock()
+			continue
+		}
+
+		settling := s.settling
+		s.settling = nil
+		s.mtx.Unlock()
+
+		if len(settling) > 0 {
+			for _, settled := range settling {
+				close(settled)
+			}
+			continue
+		}
+
+		if next, ok := s.clock.Next(); ok {
+			s.clock.FireNext(next)
+			continue
+		}
+
+		// Nothing can happen anymore, which synctest reports as a deadlock
+		<-s.closeCh
+	}
+}
+
+// drain fires the timers left once the network is closed,
+// so that nothing waits for them forever.
+func (s *Network) drain() {
+	for {
+		synctest.Wait()
+
+		next, ok := s.clock.Next()
+		if !ok {
+			return
+		}
+
+		s.clock.FireNext(next)
+	}
+}
+
+// CheckRing checks that the nodes form a single ring: following the
+// successors from any node must visit every node exactly once in ID
+// order, and each node must be the predecessor of its successor.
+// A single node forms a ring if it has neither successor nor
+// predecessor.
+func (s *Network) CheckRing(nodes []*Node) error {
+	if len(nodes) == 0 {
+		return fmt.Errorf("a ring needs at least 1 node")
+	}
+
+	if len(nodes) == 1 {
+		if nodes[0].Successor() != nil || nodes[0].Predecessor() != "" {
+			return fmt.Errorf("%s is alone but still has neighbours", nodes[0].Addr())
+		}
+
+		return nil
+	}
+
+	members := map[string]bool{}
+	for _, n := range nodes {
+		members[n.Addr()] = true
+	}
+
+	visited := map[string]bool{}
+	current := nodes[0]
+
+	for i := 0; i < len(nodes); i++ {
+		if visited[current.Addr()] {
+			return fmt.Errorf("ring closes after %d nodes at %s", i, current.Addr())
+		}
+		visited[current.Addr()] = true
+
+		successor := current.Successor()
+		if successor == nil {
+			return fmt.Errorf("%s has no successor", current.Addr())
+		}
+
+		next := successor.ListenAddr()
+		if !members[next] {
+			return fmt.Errorf("successor of %s is %s, which is not in the ring", current.Addr(), next)
+		}
+
+		s.mtx.Lock()
+		nextNode := s.byAddr[next]
+		s.mtx.Unlock()
+
+		for _, n := range nodes {
+			if n.ID().Between(current.ID(), nextNode.ID()) {
+				return fmt.Errorf("%s is between %s and its successor %s",
+					n.Addr(), current.Addr(), next)
+			}
+		}
+
+		if nextNode.Predecessor() != current.Addr() {
+			return fmt.Errorf("predecessor of %s is %s, expected %s",
+				next, nextNode.Predecessor(), current.Addr())
+		}
+
+		current = nextNode
+	}
+
+	if current != nodes[0] {
+		return fmt.Errorf("ring does not close at %s", nodes[0].Addr())
+	}
+
+	return nil
+}
+
+// reachableLocked returns true if from can connect to to.
+func (s *Network) reachableLocked(from string, to string) bool {
+	for _, addr := range []string{from, to} {
+		if n, ok := s.byAddr[addr]; ok && n.Crashed() {
+			return false
+		}
+	}
+
+	return s.partitions[from] == s.partitions[to]
+}
@@ -0,0 +1,572 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/hasyimibhar/p2p-chat/p2p"
+)
+
+const stabilizeInterval = 5 * time.Second
+
+// buildRing creates a network of n nodes with the configuration, joined
+// one at a time through the first node, and waits for the ring to
+// converge.
+func buildRing(t *testing.T, seed int64, n int, config p2p.Config) *Network {
+	network := New(seed)
+	t.Cleanup(network.Close)
+
+	bootstrap, err := network.AddNodeWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < n; i++ {
+		node, err := network.AddNodeWithConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := network.Join(node, bootstrap); err != nil {
+			t.Fatal(err)
+		}
+
+		network.Tick(stabilizeInterval)
+	}
+
+	converge(t, network, network.Live())
+
+	return network
+}
+
+// converge runs the network until the nodes form a ring.
+func converge(t *testing.T, network *Network, nodes []*Node) {
+	var err error
+	for i := 0; i < 2*len(nodes); i++ {
+		if err = network.CheckRing(nodes); err == nil {
+			return
+		}
+
+		network.Tick(stabilizeInterval)
+	}
+
+	t.Fatal("ring did not converge:", err)
+}
+
+// checkBroadcast checks that a chat message sent by the sender
+// reaches every other node.
+func checkBroadcast(t *testing.T, network *Network, sender *Node, nodes []*Node, text string) {
+	if err := sender.Chat(text); err != nil {
+		t.Fatal(err)
+	}
+	network.Settle()
+
+	for _, n := range nodes {
+		if n != sender && !n.Received(text) {
+			t.Fatalf("%s did not receive %q", n.Addr(), text)
+		}
+	}
+}
+
+func TestRing_Join(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 1, 16, p2p.Config{})
+		nodes := network.Live()
+
+		for i, sender := range []*Node{nodes[0], nodes[7], nodes[15]} {
+			checkBroadcast(t, network, sender, nodes, fmt.Sprintf("message %d", i))
+		}
+	})
+}
+
+func TestRing_Config(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		config := p2p.Config{
+			StabilizeInterval: time.Second,
+			SuccessorListSize: 4,
+		}
+
+		network := buildRing(t, 5, 8, config)
+		nodes := network.Live()
+
+		// With the default successor list size, the ring would
+		// not survive 3 adjacent crashes.
+		network.Run(2*time.Second, time.Second)
+		for _, n := range nodes[3:6] {
+			network.Crash(n)
+		}
+
+		live := network.Live()
+		for i := 0; i < 2*len(live); i++ {
+			if network.CheckRing(live) == nil {
+				break
+			}
+
+			network.Tick(time.Second)
+		}
+
+		if err := network.CheckRing(live); err != nil {
+			t.Fatal("ring did not converge:", err)
+		}
+	})
+}
+
+// checkSuccessorLists checks that the successor list of each node
+// holds the nodes following its successor along the ring.
+func checkSuccessorLists(t *testing.T, nodes []*Node, size int) {
+	byAddr := map[string]*Node{}
+	for _, n := range nodes {
+		byAddr[n.Addr()] = n
+	}
+
+	for _, n := range nodes {
+		expected := []string{}
+		next := byAddr[n.Successor().ListenAddr()]
+		for len(expected) < size {
+			next = byAddr[next.Successor().ListenAddr()]
+			if next == n {
+				break
+			}
+
+			expected = append(expected, next.Addr())
+		}
+
+		if actual := n.SuccessorList(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Fatalf("successor list of %s is %v, expected %v", n.Addr(), actual, expected)
+		}
+	}
+}
+
+func TestRing_SuccessorList(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		config := p2p.Config{SuccessorListSize: 3}
+
+		network := buildRing(t, 11, 7, config)
+		nodes := network.Live()
+
+		// Each round of stabilization brings the
+		// successor lists one node closer to complete
+		network.Run(3*stabilizeInterval, stabilizeInterval)
+		checkSuccessorLists(t, nodes, 3)
+
+		// Once the ring is smaller than the successor list,
+		// the list stops short of the node itself.
+		for _, n := range nodes[1:4] {
+			network.Crash(n)
+		}
+
+		live := network.Live()
+		converge(t, network, live)
+		network.Run(3*stabilizeInterval, stabilizeInterval)
+		checkSuccessorLists(t, live, 3)
+	})
+}
+
+func TestRing_Crash(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 2, 8, p2p.Config{})
+		nodes := network.Live()
+
+		// Let the nodes populate their successor lists
+		network.Tick(stabilizeInterval)
+
+		network.Crash(nodes[3])
+
+		live := network.Live()
+		converge(t, network, live)
+
+		checkBroadcast(t, network, live[0], live, "after crash")
+	})
+}
+
+func TestRing_PartitionedNode(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 3, 6, p2p.Config{})
+		nodes := network.Live()
+
+		network.Tick(stabilizeInterval)
+
+		// Isolate a node from the rest of the ring
+		isolated := nodes[2]
+		rest := []*Node{}
+		for _, n := range nodes {
+			if n != isolated {
+				rest = append(rest, n)
+			}
+		}
+
+		network.Partition([]*Node{isolated}, rest)
+		converge(t, network, rest)
+
+		checkBroadcast(t, network, rest[0], rest, "during partition")
+		if isolated.Received("during partition") {
+			t.Fatal("message crossed the partition")
+		}
+	})
+}
+
+func TestRing_Rejoin(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		config := p2p.Config{RejoinInterval: stabilizeInterval}
+
+		network := buildRing(t, 12, 6, config)
+		nodes := network.Live()
+
+		network.Tick(stabilizeInterval)
+
+		// Once every successor is unreachable, the node is alone
+		isolated := nodes[2]
+		rest := []*Node{}
+		for _, n := range nodes {
+			if n != isolated {
+				rest = append(rest, n)
+			}
+		}
+
+		network.Partition([]*Node{isolated}, rest)
+		converge(t, network, rest)
+
+		if isolated.Successor() != nil {
+			t.Fatal("isolated node still has a successor")
+		}
+
+		// A node which can't reach its bootstrap peer keeps trying
+		bootstrapConfig := config
+		bootstrapConfig.BootstrapPeers = []string{"node100", rest[0].Addr()}
+
+		late, err := network.AddNodeWithConfig(bootstrapConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		network.Partition([]*Node{isolated}, []*Node{late}, rest)
+		if err := late.Bootstrap(); err == nil {
+			t.Fatal("expected bootstrap to fail during partition")
+		}
+
+		// Both rejoin the ring on their own once the partition heals
+		network.Heal()
+		network.Run(4*stabilizeInterval, stabilizeInterval)
+
+		all := append(rest, isolated, late)
+		converge(t, network, all)
+		checkBroadcast(t, network, late, all, "rejoined")
+	})
+}
+
+func TestRing_Drops(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 4, 6, p2p.Config{})
+
+		// Dropped frames break connections, which the nodes
+		// must repair once the network is reliable again.
+		network.SetDropRate(0.05)
+		network.Run(3*stabilizeInterval, stabilizeInterval)
+		network.SetDropRate(0)
+
+		live := network.Live()
+		converge(t, network, live)
+
+		checkBroadcast(t, network, live[0], live, "after drops")
+	})
+}
+
+func TestRing_Lookup(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 6, 16, p2p.Config{})
+		nodes := network.Live()
+
+		// Let the nodes populate their finger tables
+		network.Run(10*stabilizeInterval, stabilizeInterval)
+
+		for _, from := range nodes {
+			for _, to := range nodes {
+				addr, key, err := from.Lookup(to.ID())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if addr != to.Addr() || !bytes.Equal(key, to.PublicKey()) {
+					t.Fatalf("%s looked up %s instead of %s", from.Addr(), addr, to.Addr())
+				}
+			}
+		}
+	})
+}
+
+func TestRing_PrivateChat(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 7, 8, p2p.Config{})
+		nodes := network.Live()
+
+		network.Run(5*stabilizeInterval, stabilizeInterval)
+
+		sender, recipient := nodes[1], nodes[6]
+
+		if err := sender.StartPrivateChat(recipient.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		network.Settle()
+
+		if err := sender.PrivateChat(recipient.PublicKey(), "hello"); err != nil {
+			t.Fatal(err)
+		}
+		if err := recipient.PrivateChat(sender.PublicKey(), "hi"); err != nil {
+			t.Fatal(err)
+		}
+		network.Settle()
+
+		if !recipient.ReceivedPrivately(sender, "hello") {
+			t.Fatal("recipient did not receive the private chat message")
+		}
+		if !sender.ReceivedPrivately(recipient, "hi") {
+			t.Fatal("sender did not receive the private chat message")
+		}
+	})
+}
+
+// checkValues checks that every key can be read from every node.
+func checkValues(t *testing.T, nodes []*Node, values map[string]string) {
+	for _, n := range nodes {
+		for key, value := range values {
+			got, err := n.Get([]byte(key))
+			if err != nil {
+				t.Fatalf("%s failed to get %s: %s", n.Addr(), key, err)
+			}
+
+			if string(got) != value {
+				t.Fatalf("%s got %q for %s instead of %q", n.Addr(), got, key, value)
+			}
+		}
+	}
+}
+
+func TestRing_PutGet(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 8, 8, p2p.Config{})
+		nodes := network.Live()
+
+		network.Run(5*stabilizeInterval, stabilizeInterval)
+
+		values := map[string]string{}
+		for i := 0; i < 32; i++ {
+			key, value := fmt.Sprintf("key %d", i), fmt.Sprintf("value %d", i)
+			if err := nodes[i%len(nodes)].Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+
+			values[key] = value
+		}
+		network.Settle()
+
+		checkValues(t, nodes, values)
+
+		if _, err := nodes[0].Get([]byte("missing")); err != p2p.ErrKeyNotFound {
+			t.Fatal("expected key not found, got", err)
+		}
+
+		// Values are handed off to joining nodes
+		for i := 0; i < 4; i++ {
+			node, err := network.AddNode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := network.Join(node, nodes[0]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		converge(t, network, network.Live())
+		network.Run(5*stabilizeInterval, stabilizeInterval)
+		checkValues(t, network.Live(), values)
+
+		// Values survive crashes thanks to replication
+		network.Crash(nodes[2])
+		network.Crash(nodes[5])
+
+		converge(t, network, network.Live())
+		network.Run(5*stabilizeInterval, stabilizeInterval)
+		checkValues(t, network.Live(), values)
+	})
+}
+
+func TestRing_Leave(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 9, 6, p2p.Config{})
+		nodes := network.Live()
+
+		network.Run(3*stabilizeInterval, stabilizeInterval)
+
+		values := map[string]string{}
+		for i := 0; i < 16; i++ {
+			key, value := fmt.Sprintf("key %d", i), fmt.Sprintf("value %d", i)
+			if err := nodes[0].Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+
+			values[key] = value
+		}
+		network.Settle()
+
+		// The ring is repaired without waiting for stabilization,
+		// even when the last node but one leaves.
+		for _, n := range nodes[1:] {
+			if err := network.Leave(n); err != nil {
+				t.Fatal(err)
+			}
+
+			live := network.Live()
+			if err := network.CheckRing(live); err != nil {
+				t.Fatalf("ring broken after %s left: %s", n.Addr(), err)
+			}
+
+			checkValues(t, live, values)
+		}
+
+		// The remaining node can still be joined
+		node, err := network.AddNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := network.Join(node, nodes[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		converge(t, network, network.Live())
+		checkValues(t, network.Live(), values)
+	})
+}
+
+func TestRing_PredecessorHang(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := buildRing(t, 10, 6, p2p.Config{})
+		nodes := network.Live()
+
+		network.Tick(stabilizeInterval)
+
+		// A hung node keeps its connections open, so its successor
+		// only notices by checking its predecessor.
+		hung := nodes[3]
+		successor := hung.Successor().ListenAddr()
+		network.Hang(hung)
+
+		live := network.Live()
+		converge(t, network, live)
+
+		for _, n := range live {
+			if n.Addr() == successor && n.Predecessor() == hung.Addr() {
+				t.Fatal("hung predecessor was not forgotten")
+			}
+		}
+
+		checkBroadcast(t, network, live[0], live, "after hang")
+	})
+}
+
+func TestRing_Merge(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		config := p2p.Config{ProbeInterval: stabilizeInterval}
+
+		network := buildRing(t, 11, 8, config)
+		nodes := network.Live()
+
+		// Let the nodes get to know each other
+		network.Run(10*stabilizeInterval, stabilizeInterval)
+
+		left, right := nodes[:4], nodes[4:]
+		network.Partition(left, right)
+
+		converge(t, network, left)
+		converge(t, network, right)
+
+		checkBroadcast(t, network, left[0], left, "left")
+		checkBroadcast(t, network, right[0], right, "right")
+
+		// Once the partition heals, the nodes find out about
+		// the other ring and merge with it
+		network.Heal()
+		converge(t, network, nodes)
+		network.Settle()
+
+		for _, n := range nodes {
+			texts := map[string]bool{}
+			for _, e := range n.ChatLog() {
+				texts[e.Text] = true
+			}
+
+			if !texts["left"] || !texts["right"] {
+				t.Fatalf("chat log of %s was not reconciled", n.Addr())
+			}
+		}
+
+		checkBroadcast(t, network, nodes[0], nodes, "merged")
+	})
+}
+
+// TestNetwork_Replay checks that a run, faults included,
+// can be replayed from its seed.
+func TestNetwork_Replay(t *testing.T) {
+	run := func() []delivery {
+		var deliveries []delivery
+		synctest.Test(t, func(t *testing.T) {
+			config := p2p.Config{ProbeInterval: stabilizeInterval}
+
+			network := buildRing(t, 13, 8, config)
+			nodes := network.Live()
+
+			network.SetDropRate(0.05)
+			network.Run(3*stabilizeInterval, stabilizeInterval)
+			network.SetDropRate(0)
+
+			network.Crash(nodes[2])
+			network.Partition(nodes[:4], nodes[4:])
+			network.Run(3*stabilizeInterval, stabilizeInterval)
+			network.Heal()
+			network.Run(5*stabilizeInterval, stabilizeInterval)
+
+			network.Hang(nodes[5])
+			network.Run(3*stabilizeInterval, stabilizeInterval)
+
+			if _, _, err := nodes[0].Lookup(nodes[6].ID()); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := nodes[0].Chat("replayed"); err != nil {
+				t.Fatal(err)
+			}
+			network.Settle()
+
+			network.mtx.Lock()
+			deliveries = append(deliveries, network.deliveries...)
+			network.mtx.Unlock()
+		})
+
+		return deliveries
+	}
+
+	first, second := run(), run()
+
+	dropped := 0
+	for i := 0; i < len(first) && i < len(second); i++ {
+		if first[i] != second[i] {
+			t.Fatalf("runs diverge at delivery %d: %+v, then %+v", i, first[i], second[i])
+		}
+
+		if first[i].dropped {
+			dropped++
+		}
+	}
+
+	if len(first) != len(second) {
+		t.Fatalf("runs have %d and %d deliveries", len(first), len(second))
+	}
+
+	if dropped == 0 {
+		t.Fatal("expected some frames to be dropped")
+	}
+}
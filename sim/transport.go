@@ -0,0 +1,365 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errReset       = fmt.Errorf("connection reset by network")
+	errNoDeadlines = fmt.Errorf("deadlines are not supported by the simulated network")
+)
+
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// nodeTransport is the Transport of a single node in the network.
+type nodeTransport struct {
+	network *Network
+	addr    string
+}
+
+func (t *nodeTransport) Listen(addr string) (net.Listener, error) {
+	return t.network.listen(addr)
+}
+
+// Dial connects to addr right away, or fails right away if the network's
+// faults forbid it, so the timeout never elapses.
+func (t *nodeTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.network.dial(t.addr, addr)
+}
+
+func (t *nodeTransport) CheckAddr(addr string, remote net.Addr) error {
+	if addr == "" {
+		return fmt.Errorf("missing address")
+	}
+
+	return nil
+}
+
+// listener accepts the links dialed to a node. Like the rest of the
+// network's state, it's guarded by the network's mutex.
+type listener struct {
+	network *Network
+	addr    string
+	backlog []*end
+	closed  bool
+	cond    *sync.Cond
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	l.network.mtx.Lock()
+	defer l.network.mtx.Unlock()
+
+	for len(l.backlog) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+
+	conn := l.backlog[0]
+	l.backlog = l.backlog[1:]
+	return conn, nil
+}
+
+// Close stops listening, and resets the links which
+// have not been accepted yet.
+func (l *listener) Close() error {
+	l.network.mtx.Lock()
+	defer l.network.mtx.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	for _, e := range l.backlog {
+		e.link.breakLocked()
+	}
+	l.backlog = nil
+
+	if l.network.listeners[l.addr] == l {
+		delete(l.network.listeners, l.addr)
+	}
+
+	l.cond.Broadcast()
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return simAddr(l.addr)
+}
+
+// link is a connection from one node to another. What either end
+// writes is held in transit until the network delivers it to the
+// other end.
+type link struct {
+	from    string
+	to      string
+	seq     int
+	ends    [2]*end
+	transit [2][]segment
+	broken  bool
+}
+
+// segment is what a single write puts in transit, i.e. a whole frame,
+// or the end of the stream once the writing end has been closed. step
+// is the step of the network during which it was written.
+type segment struct {
+	data []byte
+	fin  bool
+	step int
+}
+
+// before returns true if the next segment sent by the side of the link
+// must be delivered before the next one sent by the other side of other.
+// Segments are delivered in the order of the steps they were sent in,
+// and segments sent during the same step in the order of their links.
+func (l *link) before(side int, other *link, otherSide int) bool {
+	a, b := l.transit[side][0], other.transit[otherSide][0]
+	switch {
+	case a.step != b.step:
+		return a.step < b.step
+	case l.from != other.from:
+		return l.from < other.from
+	case l.to != other.to:
+		return l.to < other.to
+	case l.seq != other.seq:
+		return l.seq < other.seq
+	}
+
+	return side < otherSide
+}
+
+// done returns true if nothing can travel over the link anymore.
+func (l *link) done() bool {
+	return l.broken || (l.ends[0].closed && l.ends[1].closed &&
+		len(l.transit[0]) == 0 && len(l.transit[1]) == 0)
+}
+
+// breakLocked breaks the link like a reset TCP connection: both ends
+// fail, and whatever is in transit is lost.
+func (l *link) breakLocked() {
+	l.broken = true
+	l.transit = [2][]segment{}
+
+	for _, e := range l.ends {
+		e.cond.Broadcast()
+	}
+}
+
+// end is one end of a link. owner is the address of the node at this
+// end, and side the index of the end in the link.
+type end struct {
+	network *Network
+	link    *link
+	side    int
+	owner   string
+	local   simAddr
+	remote  simAddr
+	buf     bytes.Buffer
+	eof     bool
+	closed  bool
+	cond    *sync.Cond
+}
+
+func (e *end) Read(b []byte) (int, error) {
+	e.network.mtx.Lock()
+	defer e.network.mtx.Unlock()
+
+	for {
+		switch {
+		case e.closed:
+			return 0, net.ErrClosed
+		case e.link.broken:
+			return 0, errReset
+		case e.buf.Len() > 0:
+			return e.buf.Read(b)
+		case e.eof:
+			return 0, io.EOF
+		}
+
+		e.cond.Wait()
+	}
+}
+
+// Write puts the frame in transit. Frames sent by a hung node are
+// discarded without breaking the link.
+func (e *end) Write(b []byte) (int, error) {
+	s := e.network
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch {
+	case e.closed:
+		return 0, net.ErrClosed
+	case e.link.broken:
+		return 0, errReset
+	case s.hungLocked(e.owner):
+		return len(b), nil
+	}
+
+	e.link.transit[e.side] = append(e.link.transit[e.side], segment{
+		data: append([]byte{}, b...),
+		step: s.step,
+	})
+
+	return len(b), nil
+}
+
+// Close closes the end. The other end reads what is already in
+// transit, then the end of the stream.
+func (e *end) Close() error {
+	s := e.network
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if e.closed {
+		return nil
+	}
+
+	e.closed = true
+	if !e.link.broken && !s.hungLocked(e.owner) {
+		e.link.transit[e.side] = append(e.link.transit[e.side], segment{
+			fin:  true,
+			step: s.step,
+		})
+	}
+
+	e.cond.Broadcast()
+	return nil
+}
+
+func (e *end) LocalAddr() net.Addr  { return e.local }
+func (e *end) RemoteAddr() net.Addr { return e.remote }
+
+func (e *end) SetDeadline(t time.Time) error      { return errNoDeadlines }
+func (e *end) SetReadDeadline(t time.Time) error  { return errNoDeadlines }
+func (e *end) SetWriteDeadline(t time.Time) error { return errNoDeadlines }
+
+func (s *Network) listen(addr string) (net.Listener, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, exists := s.listeners[addr]; exists {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+
+	ln := &listener{
+		network: s,
+		addr:    addr,
+		cond:    sync.NewCond(&s.mtx),
+	}
+	s.listeners[addr] = ln
+
+	return ln, nil
+}
+
+// dial links from to the node listening at to, and puts
+// the link in the backlog of its listener.
+func (s *Network) dial(from string, to string) (net.Conn, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.reachableLocked(from, to) {
+		return nil, fmt.Errorf("dial %s: network is unreachable", to)
+	}
+
+	ln, ok := s.listeners[to]
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", to)
+	}
+
+	key := from + " " + to
+	l := &link{from: from, to: to, seq: s.dials[key]}
+	s.dials[key]++
+
+	port := simAddr(fmt.Sprintf("%s#%d", from, l.seq))
+	for side, owner := range []string{from, to} {
+		l.ends[side] = &end{
+			network: s,
+			link:    l,
+			side:    side,
+			owner:   owner,
+			cond:    sync.NewCond(&s.mtx),
+		}
+	}
+
+	l.ends[0].local, l.ends[0].remote = port, simAddr(to)
+	l.ends[1].local, l.ends[1].remote = simAddr(to), port
+
+	s.links = append(s.links, l)
+	ln.backlog = append(ln.backlog, l.ends[1])
+	ln.cond.Broadcast()
+
+	return l.ends[0], nil
+}
+
+// deliverLocked delivers the next segment in transit, and returns false
+// if there's none. Whether a frame is dropped is drawn from the network's
+// source as it's delivered. Since frames travel over reliable streams, a
+// dropped frame breaks its link, just like a TCP connection which times
+// out.
+func (s *Network) deliverLocked() bool {
+	var next *link
+	side := 0
+
+	pending := s.links[:0]
+	for _, l := range s.links {
+		if l.done() {
+			continue
+		}
+		pending = append(pending, l)
+
+		for i := range l.transit {
+			if len(l.transit[i]) > 0 && (next == nil || l.before(i, next, side)) {
+				next, side = l, i
+			}
+		}
+	}
+	s.links = pending
+
+	if next == nil {
+		return false
+	}
+
+	seg := next.transit[side][0]
+	next.transit[side] = next.transit[side][1:]
+	dst := next.ends[1-side]
+
+	d := delivery{from: next.ends[side].owner, to: dst.owner, size: len(seg.data), fin: seg.fin}
+
+	switch {
+	case seg.fin:
+		dst.eof = true
+	case s.dropRate > 0 && s.rng.Float64() < s.dropRate:
+		d.dropped = true
+		next.breakLocked()
+	default:
+		dst.buf.Write(seg.data)
+	}
+
+	dst.cond.Broadcast()
+	s.deliveries = append(s.deliveries, d)
+	return true
+}
+
+// breakLinks breaks the links matching the filter.
+func (s *Network) breakLinks(filter func(l *link) bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, l := range s.links {
+		if !l.broken && filter(l) {
+			l.breakLocked()
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Memory is an in-process Transport, which connects nodes living in
+// the same process without using any ports. Addresses are arbitrary
+// strings. Unlike net.Pipe, writes are buffered, so connections behave
+// like TCP connections with infinitely large buffers.
+type Memory struct {
+	mtx       sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int
+}
+
+// NewMemory creates an in-memory network.
+func NewMemory() *Memory {
+	return &Memory{
+		listeners: map[string]*memoryListener{},
+	}
+}
+
+func (m *Memory) Listen(addr string) (net.Listener, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, exists := m.listeners[addr]; exists {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+
+	ln := &memoryListener{
+		network: m,
+		addr:    memoryAddr(addr),
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+	m.listeners[addr] = ln
+
+	return ln, nil
+}
+
+func (m *Memory) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	m.mtx.Lock()
+	ln, exists := m.listeners[addr]
+	m.nextPort++
+	local := memoryAddr(fmt.Sprintf("%s#%d", addr, m.nextPort))
+	m.mtx.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+
+	client, server := newMemoryConnPair(local, memoryAddr(addr))
+
+	// The connection is established once the listener accepts it
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case ln.connCh <- server:
+		return client, nil
+	case <-ln.closeCh:
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	case <-timeoutCh:
+		return nil, fmt.Errorf("dial %s: i/o timeout", addr)
+	}
+}
+
+// CheckAddr accepts any address but the empty one.
+func (m *Memory) CheckAddr(addr string, remote net.Addr) error {
+	if addr == "" {
+		return fmt.Errorf("missing address")
+	}
+
+	return nil
+}
+
+func (m *Memory) removeListener(ln *memoryListener) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.listeners[string(ln.addr)] == ln {
+		delete(m.listeners, string(ln.addr))
+	}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+type memoryListener struct {
+	network   *Memory
+	addr      memoryAddr
+	connCh    chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+		l.network.removeListener(l)
+	})
+
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryBuffer is one direction of a connection.
+type memoryBuffer struct {
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	b := &memoryBuffer{}
+	b.cond = sync.NewCond(&b.mtx)
+	return b
+}
+
+func (b *memoryBuffer) read(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for b.buf.Len() == 0 {
+		if b.closed {
+			return 0, io.EOF
+		}
+
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, timeoutError{}
+		}
+
+		b.cond.Wait()
+	}
+
+	return b.buf.Read(p)
+}
+
+func (b *memoryBuffer) write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, _ := b.buf.Write(p)
+	b.cond.Broadcast()
+
+	return n, nil
+}
+
+func (b *memoryBuffer) close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *memoryBuffer) setDeadline(t time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	b.deadline = t
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mtx.Lock()
+			defer b.mtx.Unlock()
+
+			b.cond.Broadcast()
+		})
+	}
+
+	b.cond.Broadcast()
+}
+
+type memoryConn struct {
+	local     memoryAddr
+	remote    memoryAddr
+	readBuf   *memoryBuffer
+	writeBuf  *memoryBuffer
+	mtx       sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+func newMemoryConnPair(client memoryAddr, server memoryAddr) (*memoryConn, *memoryConn) {
+	clientToServer := newMemoryBuffer()
+	serverToClient := newMemoryBuffer()
+
+	return &memoryConn{
+		local:    client,
+		remote:   server,
+		readBuf:  serverToClient,
+		writeBuf: clientToServer,
+	}, &memoryConn{
+		local:    server,
+		remote:   client,
+		readBuf:  clientToServer,
+		writeBuf: serverToClient,
+	}
+}
+
+func (c *memoryConn) isClosed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.closed
+}
+
+func (c *memoryConn) Read(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	n, err := c.readBuf.read(p)
+	if err == io.EOF && c.isClosed() {
+		return n, net.ErrClosed
+	}
+
+	return n, err
+}
+
+func (c *memoryConn) Write(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	return c.writeBuf.write(p)
+}
+
+// Close closes both directions of the connection. Data which
+// has already been written can still be read by the other side.
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mtx.Lock()
+		c.closed = true
+		c.mtx.Unlock()
+
+		c.readBuf.close()
+		c.writeBuf.close()
+	})
+
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.readBuf.setDeadline(t)
+	return nil
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.readBuf.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, since writes never block.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
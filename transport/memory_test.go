@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemory_DialListen(t *testing.T) {
+	network := NewMemory()
+
+	ln, err := network.Listen("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, err := network.Listen("node1"); err == nil {
+		t.Fatal("expected address to be in use")
+	}
+
+	if _, err := network.Dial("node2", 0); err == nil {
+		t.Fatal("expected connection to be refused")
+	}
+
+	acceptCh := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		acceptCh <- conn
+	}()
+
+	client, err := network.Dial("node1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-acceptCh
+
+	if server.LocalAddr().String() != "node1" || client.RemoteAddr().String() != "node1" {
+		t.Fatal("incorrect address")
+	}
+
+	// Writes are buffered, so they don't wait for the reader
+	for _, msg := range []string{"hello, ", "world"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.Close()
+
+	received, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "hello, world" {
+		t.Fatal("incorrect data received")
+	}
+
+	if _, err := server.Write([]byte("foo")); err == nil {
+		t.Fatal("expected write to closed connection to fail")
+	}
+}
+
+func TestMemory_ListenerClose(t *testing.T) {
+	network := NewMemory()
+
+	ln, _ := network.Listen("node1")
+	ln.Close()
+
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("expected accept to fail")
+	}
+
+	if _, err := network.Dial("node1", 0); err == nil {
+		t.Fatal("expected connection to be refused")
+	}
+
+	// The address can be reused
+	ln, err := network.Listen("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestMemory_ReadDeadline(t *testing.T) {
+	network := NewMemory()
+
+	ln, _ := network.Listen("node1")
+	defer ln.Close()
+
+	go ln.Accept()
+
+	conn, err := network.Dial("node1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	_, err = conn.Read(make([]byte, 1))
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Fatal("expected timeout error")
+	}
+}
+
+func TestMemory_DialTimeout(t *testing.T) {
+	network := NewMemory()
+
+	// Nobody accepts connections
+	ln, _ := network.Listen("node1")
+	defer ln.Close()
+
+	if _, err := network.Dial("node1", 10*time.Millisecond); err == nil {
+		t.Fatal("expected dial to time out")
+	}
+}
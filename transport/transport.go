@@ -0,0 +1,70 @@
+// Package transport provides the streams over which nodes talk to
+// each other, so that the node is not tied to TCP.
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Transport creates connections between nodes.
+type Transport interface {
+	// Listen listens for connections on the address.
+	Listen(addr string) (net.Listener, error)
+
+	// Dial connects to the node listening on the address. If timeout
+	// is not zero, Dial fails if the connection cannot be established
+	// in time.
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+
+	// CheckAddr sanity checks the address a node connected from
+	// remote advertises. It only rejects addresses which obviously
+	// cannot be reached, without connecting to them, so the node
+	// still connects back to the addresses which pass. remote may be
+	// nil if the address is not advertised by a peer, e.g. at startup.
+	CheckAddr(addr string, remote net.Addr) error
+}
+
+// TCP is a Transport over TCP.
+type TCP struct{}
+
+func (t TCP) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (t TCP) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// CheckAddr requires a host and port to connect to. A peer connected
+// from another host can't be reached at a loopback address, nor can
+// any peer be reached at an unspecified or multicast address. The
+// check is syntactic: the host is neither resolved nor dialed.
+func (t TCP) CheckAddr(addr string, remote net.Addr) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("address %s: invalid port", addr)
+	}
+
+	if host == "" {
+		return fmt.Errorf("address %s: missing host", addr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && (ip.IsUnspecified() || ip.IsMulticast()) {
+		return fmt.Errorf("address %s: cannot connect to %s", addr, host)
+	}
+
+	loopback := host == "localhost" || (ip != nil && ip.IsLoopback())
+	if tcpAddr, ok := remote.(*net.TCPAddr); ok && loopback && !tcpAddr.IP.IsLoopback() {
+		return fmt.Errorf("address %s: loopback address advertised from %s", addr, remote)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTCP_CheckAddr(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+
+	tests := []struct {
+		addr   string
+		remote net.Addr
+		valid  bool
+	}{
+		{"localhost:8000", nil, true},
+		{"localhost:8000", local, true},
+		{"localhost:8000", remote, false},
+		{"127.0.0.1:8000", remote, false},
+		{"[::1]:8000", local, true},
+		{"[::1]:8000", remote, false},
+		{"192.0.2.2:8000", remote, true},
+		{"[2001:db8::1]:8000", remote, true},
+		{"example.com:8000", remote, true},
+		{"0.0.0.0:8000", nil, false},
+		{"[::]:8000", nil, false},
+		{"[ff02::1]:8000", nil, false},
+		{":8000", nil, false},
+		{"localhost", nil, false},
+		{"localhost:0", nil, false},
+		{"localhost:65536", nil, false},
+		{"::1:8000", nil, false},
+	}
+
+	for _, test := range tests {
+		err := TCP{}.CheckAddr(test.addr, test.remote)
+		if test.valid && err != nil {
+			t.Errorf("%s from %v: unexpected error: %s", test.addr, test.remote, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s from %v: expected error", test.addr, test.remote)
+		}
+	}
+}
+
+func TestTCP_IPv6(t *testing.T) {
+	ln, err := TCP{}.Listen("[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := TCP{}.Dial(ln.Addr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,52 @@
+package x25519
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	KeySize = 32
+)
+
+// GenerateKey generates an X25519 key pair used for key agreement.
+// It is separate from the Ed25519 key pair, which is only used
+// for signing.
+func GenerateKey() (privkey []byte, pubkey []byte, err error) {
+	var priv, pub [KeySize]byte
+
+	if _, err = rand.Read(priv[:]); err != nil {
+		return
+	}
+
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	privkey, pubkey = priv[:], pub[:]
+	return
+}
+
+// ComputeSharedSecret performs Diffie-Hellman between the private key
+// and the peer's public key.
+func ComputeSharedSecret(privkey []byte, pubkey []byte) ([]byte, error) {
+	if len(privkey) != KeySize || len(pubkey) != KeySize {
+		return nil, fmt.Errorf("invalid key size")
+	}
+
+	var priv, pub, secret [KeySize]byte
+	copy(priv[:], privkey)
+	copy(pub[:], pubkey)
+
+	curve25519.ScalarMult(&secret, &priv, &pub)
+
+	// Reject low-order points, which would result in an
+	// all-zero shared secret.
+	var zero [KeySize]byte
+	if subtle.ConstantTimeCompare(secret[:], zero[:]) == 1 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	return secret[:], nil
+}
@@ -0,0 +1,33 @@
+package x25519
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestComputeSharedSecret(t *testing.T) {
+	a, A, _ := GenerateKey()
+	b, B, _ := GenerateKey()
+
+	secretA, err := ComputeSharedSecret(a, B)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secretB, err := ComputeSharedSecret(b, A)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(secretA, secretB) {
+		t.Fatal("aB is not equal to bA")
+	}
+}
+
+func TestComputeSharedSecret_LowOrderPoint(t *testing.T) {
+	a, _, _ := GenerateKey()
+
+	if _, err := ComputeSharedSecret(a, make([]byte, KeySize)); err == nil {
+		t.Fatal("expected error for low-order public key")
+	}
+}